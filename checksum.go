@@ -0,0 +1,66 @@
+package mc
+
+// Integrity of values.
+//
+// When Config.Checksum is set, values are stored in an envelope made of a
+// CRC32C checksum (4 bytes), Config.SchemaVersion (2 bytes) and the value, and
+// marked as such in their flags. The checksum covers the key, the schema
+// version and the value, so bytes corrupted or written under the wrong key are
+// detected by readers, which return ErrChecksumMismatch instead of the value.
+// Values written with a different schema version are reported as misses, so
+// changing the version invalidates values in an incompatible format. The
+// envelope is checked and stripped by every reader, based on the marker: readers
+// without Checksum set only skip the schema version check.
+//
+// The envelope is added last (after compression and encryption), so it covers
+// the bytes actually stored.
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+const checksumHeaderLen = 6
+
+// valueChecksum computes the checksum of val stored under key with schema.
+func valueChecksum(key string, schema []byte, val string) uint32 {
+	crc := crc32.Update(0, castagnoli, []byte(key))
+	crc = crc32.Update(crc, castagnoli, schema)
+	return crc32.Update(crc, castagnoli, []byte(val))
+}
+
+// addChecksum wraps val stored under key in a checksum envelope as configured
+// and returns the flags to store along with it.
+func (c *Client) addChecksum(key, val string, flags uint32) (string, uint32) {
+	if !c.config.Checksum {
+		return val, flags
+	}
+	var header [checksumHeaderLen]byte
+	binary.BigEndian.PutUint16(header[4:], c.config.SchemaVersion)
+	binary.BigEndian.PutUint32(header[:4], valueChecksum(key, header[4:], val))
+	return string(header[:]) + val, flags | flagChecksum
+}
+
+// verifyChecksum unwraps val read from key according to flags, checking its
+// checksum and schema version.
+func (c *Client) verifyChecksum(key, val string, flags uint32) (string, error) {
+	if flags&flagChecksum == 0 {
+		return val, nil
+	}
+	if len(val) < checksumHeaderLen {
+		atomic.AddUint64(&c.metrics.checksumMismatches, 1)
+		return "", ErrChecksumMismatch
+	}
+
+	header := []byte(val[:checksumHeaderLen])
+	val = val[checksumHeaderLen:]
+	if binary.BigEndian.Uint32(header) != valueChecksum(key, header[4:], val) {
+		atomic.AddUint64(&c.metrics.checksumMismatches, 1)
+		return "", ErrChecksumMismatch
+	}
+	if c.config.Checksum && binary.BigEndian.Uint16(header[4:]) != c.config.SchemaVersion {
+		return "", ErrNotFound
+	}
+	return val, nil
+}
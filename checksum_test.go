@@ -0,0 +1,76 @@
+package mc
+
+import (
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Checksum = true
+	config.SchemaVersion = 3
+	c := fc.client("a", config)
+
+	const FLAGS uint32 = 42
+	_, err := c.Set("foo", "bar", FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ := fc.server("a").get("foo")
+	assertTruef(t, it.flags&flagChecksum != 0, "value should be marked")
+	assertEqualf(t, checksumHeaderLen+3, len(it.val), "wrong envelope length: %d", len(it.val))
+
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+
+	// corrupted bytes and values written under the wrong key are detected
+	srv := fc.server("a")
+	srv.lock.Lock()
+	srv.store("corrupt", it.val[:len(it.val)-1]+"z", it.flags, 0)
+	srv.store("crossed", it.val, it.flags, 0)
+	srv.store("short", "abc", it.flags, 0)
+	srv.lock.Unlock()
+	for _, key := range []string{"corrupt", "crossed", "short"} {
+		_, _, _, err = c.Get(key)
+		assertEqualf(t, ErrChecksumMismatch, err, "%s: expected checksum mismatch: %v", key, err)
+	}
+	assertEqualf(t, uint64(3), c.Metrics().ChecksumMismatches, "wrong metric: %v", c.Metrics())
+
+	// values written with another schema version are misses
+	config = DefaultConfig()
+	config.Checksum = true
+	config.SchemaVersion = 4
+	_, _, _, err = fc.client("a", config).Get("foo")
+	assertEqualf(t, ErrNotFound, err, "expected miss on schema mismatch: %v", err)
+
+	// readers without Checksum verify and strip the envelope as well
+	reader := fc.client("a", DefaultConfig())
+	v, f, _, err = reader.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	_, _, _, err = reader.Get("corrupt")
+	assertEqualf(t, ErrChecksumMismatch, err, "expected checksum mismatch: %v", err)
+
+	// plain values are still readable
+	_, err = fc.client("a", DefaultConfig()).Set("plain", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = c.Get("plain")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+}
+
+func TestChecksumWithEncryption(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Checksum = true
+	config.Encryption = testKeyRing(t, 1)
+	config.ChunkSize = 16
+	c := fc.client("a", config)
+
+	_, err := c.Set("foo", "a value spanning several chunks", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "a value spanning several chunks", v, "wrong value: %v", v)
+}
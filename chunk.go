@@ -0,0 +1,222 @@
+package mc
+
+// Transparent splitting of values too large for a single memcached item.
+//
+// A value larger than Config.ChunkSize is stored as a number of chunks under
+// derived keys, written in a single pipelined batch, followed by a manifest
+// stored under the key itself (flagged with flagChunked). The manifest records
+// the chunks and a checksum of the whole value, so a reader can fetch all
+// chunks with a multi-get and verify them. As memcached may evict any chunk
+// independently, a value with missing (or mismatching) chunks is a miss.
+//
+// Chunk keys include a random id picked on each write, so concurrent writers of
+// the same key never mix their chunks, and a manifest never refers to chunks of
+// another write. Chunks of a write failing before its manifest is stored are
+// deleted, but chunks of overwritten or deleted values aren't removed, they are
+// left to expire or to be evicted.
+//
+// Manifests are read from the cache, so they are checked before any chunk is
+// fetched: a value has at most maxChunks chunks of at most maxChunkLen bytes
+// (or ChunkSize if larger).
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const manifestVersion = 1
+
+const (
+	// maxChunks bounds the number of chunks of a value.
+	maxChunks = 1 << 16
+	// maxChunkLen bounds the length of the chunks read, the default item size
+	// limit of memcached.
+	maxChunkLen = 1 << 20
+)
+
+// manifest size: version (1), id (8), chunks (4), length (8), checksum (4)
+const manifestLen = 25
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkManifest describes a value split across several keys.
+type chunkManifest struct {
+	id       uint64
+	chunks   uint32
+	length   uint64
+	checksum uint32
+}
+
+func (cm *chunkManifest) encode() string {
+	var b [manifestLen]byte
+	b[0] = manifestVersion
+	binary.BigEndian.PutUint64(b[1:], cm.id)
+	binary.BigEndian.PutUint32(b[9:], cm.chunks)
+	binary.BigEndian.PutUint64(b[13:], cm.length)
+	binary.BigEndian.PutUint32(b[21:], cm.checksum)
+	return string(b[:])
+}
+
+func decodeManifest(s string) (cm chunkManifest, ok bool) {
+	if len(s) != manifestLen || s[0] != manifestVersion {
+		return cm, false
+	}
+	b := []byte(s)
+	cm.id = binary.BigEndian.Uint64(b[1:])
+	cm.chunks = binary.BigEndian.Uint32(b[9:])
+	cm.length = binary.BigEndian.Uint64(b[13:])
+	cm.checksum = binary.BigEndian.Uint32(b[21:])
+	return cm, true
+}
+
+// validManifest returns whether the value described by cm can have been
+// written by a client reading it.
+func (c *Client) validManifest(cm chunkManifest) bool {
+	chunkLen := uint64(maxChunkLen)
+	if size := uint64(c.config.ChunkSize); size > chunkLen {
+		chunkLen = size
+	}
+	return cm.chunks > 0 && cm.chunks <= maxChunks &&
+		cm.length >= uint64(cm.chunks) && cm.length <= uint64(cm.chunks)*chunkLen
+}
+
+// chunkKey returns the key of chunk i of a value stored under key.
+func chunkKey(key string, id uint64, i int) string {
+	return derivedKey("", key, ":chunk:"+strconv.FormatUint(id, 36)+":"+strconv.Itoa(i))
+}
+
+// setChunked stores the value of the set request m as chunks and then performs
+// m with the value replaced by the manifest. Operation, CAS, flags and
+// expiration of m apply to the manifest, chunks share its expiration.
+func (c *Client) setChunked(m *msg) (cas uint64, err error) {
+	flags := m.iextras[0].(uint32)
+	exp := m.iextras[1].(uint32)
+
+	var id [8]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return 0, wrapError(StatusUnknownError, err)
+	}
+	cm := chunkManifest{
+		id:       binary.BigEndian.Uint64(id[:]),
+		length:   uint64(len(m.val)),
+		checksum: crc32.Checksum([]byte(m.val), castagnoli),
+	}
+
+	size := c.config.ChunkSize
+	if (len(m.val)+size-1)/size > maxChunks {
+		return 0, ErrValueTooLarge
+	}
+	chunks := make([]*msg, 0, (len(m.val)+size-1)/size)
+	for off := 0; off < len(m.val); off += size {
+		end := off + size
+		if end > len(m.val) {
+			end = len(m.val)
+		}
+		chunks = append(chunks, &msg{
+			header: header{
+				Op: opSetQ,
+			},
+			iextras: []interface{}{uint32(0), exp},
+			key:     chunkKey(m.key, cm.id, len(chunks)),
+			val:     m.val[off:end],
+		})
+	}
+	cm.chunks = uint32(len(chunks))
+
+	key := m.key
+	if err = c.performBatch(chunks); err != nil {
+		c.deleteChunks(key, cm)
+		return 0, err
+	}
+	for _, chunk := range chunks {
+		if err = newError(chunk.ResvOrStatus); err != nil {
+			c.deleteChunks(key, cm)
+			return 0, err
+		}
+	}
+
+	m.iextras = []interface{}{flags | flagChunked, exp}
+	m.val = cm.encode()
+	if err = c.perform(m); err != nil {
+		// e.g. a CAS mismatch, no manifest refers to the chunks
+		c.deleteChunks(key, cm)
+	}
+	return m.CAS, err
+}
+
+// deleteChunks deletes the chunks described by cm of a value stored under key,
+// ignoring errors.
+func (c *Client) deleteChunks(key string, cm chunkManifest) {
+	chunks := make([]*msg, cm.chunks)
+	for i := range chunks {
+		chunks[i] = &msg{
+			header: header{
+				Op: opDeleteQ,
+			},
+			key: chunkKey(key, cm.id, i),
+		}
+	}
+	c.performBatch(chunks)
+}
+
+// joinChunks retrieves the chunks described by the manifest stored under key
+// and returns the value they make up. op is the quiet get variant to use, exp
+// the expiration to set when op is a GAT. A missing chunk or a checksum
+// mismatch results in ErrNotFound.
+func (c *Client) joinChunks(key, manifest string, op opCode, exp uint32) (string, error) {
+	cm, ok := decodeManifest(manifest)
+	if !ok || !c.validManifest(cm) {
+		return "", ErrNotFound
+	}
+
+	chunks := make([]*msg, cm.chunks)
+	for i := range chunks {
+		chunks[i] = &msg{
+			header: header{
+				Op: op,
+			},
+			key: chunkKey(key, cm.id, i),
+		}
+		if op == opGATKQ {
+			chunks[i].iextras = []interface{}{exp}
+		}
+	}
+	if err := c.performBatch(chunks); err != nil {
+		return "", err
+	}
+
+	var val strings.Builder
+	var checksum uint32
+	val.Grow(int(cm.length))
+	for i, chunk := range chunks {
+		if chunk.ResvOrStatus == StatusNotFound && c.config.Replicas > 1 {
+			// batches only read from the primary, the chunk may be on a replica
+			chunk = &msg{
+				header: header{
+					Op: opGet,
+				},
+				key: chunkKey(key, cm.id, i),
+			}
+			if op == opGATKQ {
+				chunk.Op = opGAT
+				chunk.iextras = []interface{}{exp}
+			}
+			if err := c.perform(chunk); err != nil {
+				return "", err
+			}
+		}
+		if err := newError(chunk.ResvOrStatus); err != nil {
+			return "", err
+		}
+		val.WriteString(chunk.val)
+		checksum = crc32.Update(checksum, castagnoli, []byte(chunk.val))
+	}
+
+	if uint64(val.Len()) != cm.length || checksum != cm.checksum {
+		return "", ErrNotFound
+	}
+	return val.String(), nil
+}
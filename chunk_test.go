@@ -0,0 +1,187 @@
+package mc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testChunkedValue() string {
+	return strings.Repeat("0123456789", 1000) + "end"
+}
+
+func TestChunkedSetGet(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.ChunkSize = 1000
+	c := fc.client("a,b,c", config)
+
+	const (
+		Key1         = "big"
+		FLAGS uint32 = 921321
+	)
+	val := testChunkedValue()
+
+	cas, err := c.Set(Key1, val, FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, f, cas2, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, v, "wrong value (%d bytes)", len(v))
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertEqualf(t, cas, cas2, "CAS of the manifest should be returned: %d, %d", cas, cas2)
+
+	// chunks are spread across servers
+	chunks := 0
+	for _, addr := range []string{"a", "b", "c"} {
+		for _, k := range fc.server(addr).keys() {
+			if strings.HasPrefix(k, Key1+":chunk:") {
+				chunks++
+			}
+		}
+	}
+	assertEqualf(t, 11, chunks, "wrong number of chunks: %d", chunks)
+
+	// a client without chunking enabled still reads chunked values
+	config2 := DefaultConfig()
+	v, _, _, err = fc.client("a,b,c", config2).Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, v, "wrong value (%d bytes)", len(v))
+
+	// CAS applies to the manifest
+	_, err = c.Set(Key1, val, 0, 0, cas+1)
+	assertEqualf(t, ErrKeyExists, err, "expected CAS mismatch: %v", err)
+
+	// small values are stored as is
+	_, err = c.Set("small", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	s, _ := c.getServer("small")
+	it, _ := fc.server(s.address).get("small")
+	assertEqualf(t, "bar", it.val, "small value shouldn't be chunked: %q", it.val)
+}
+
+func TestChunkedMissingChunk(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.ChunkSize = 1000
+	c := fc.client("a,b", config)
+
+	const Key1 = "big"
+	_, err := c.Set(Key1, testChunkedValue(), 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// evict a single chunk
+	evicted := false
+	for _, addr := range []string{"a", "b"} {
+		for _, k := range fc.server(addr).keys() {
+			if !evicted && strings.HasSuffix(k, ":3") {
+				fc.server(addr).delete(k)
+				evicted = true
+			}
+		}
+	}
+	assertTruef(t, evicted, "no chunk found")
+
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "value with a missing chunk should be a miss: %v", err)
+}
+
+func TestChunkedGAT(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.ChunkSize = 1000
+	c := fc.client("a", config)
+
+	const Key1 = "big"
+	val := testChunkedValue()
+	_, err := c.Set(Key1, val, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, _, _, err := c.GAT(Key1, 100)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, v, "wrong value (%d bytes)", len(v))
+
+	for _, k := range fc.server("a").keys() {
+		it, _ := fc.server("a").get(k)
+		assertTruef(t, !it.expires.IsZero(), "expiration not updated for %s", k)
+	}
+}
+
+func TestChunkedGetTo(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.ChunkSize = 1000
+	c := fc.client("a", config)
+
+	const FLAGS uint32 = 42
+	_, err := c.Set("big", testChunkedValue(), FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set("small", "bar", FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// chunked values aren't streamed
+	var buf bytes.Buffer
+	f, _, err := c.GetTo("big", &buf)
+	assertEqualf(t, ErrNotStreamable, err, "chunked value shouldn't be streamed: %v", err)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertEqualf(t, 0, buf.Len(), "manifest shouldn't be written: %d bytes", buf.Len())
+
+	f, _, err = c.GetTo("small", &buf)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertEqualf(t, "bar", buf.String(), "wrong value: %v", buf.String())
+}
+
+func TestChunkedManifestChecks(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.ChunkSize = 1000
+	c := fc.client("a", config)
+	srv := fc.server("a")
+
+	// forged manifests aren't trusted
+	for _, cm := range []chunkManifest{
+		{id: 1, chunks: 1 << 31, length: 1 << 40},
+		{id: 1, chunks: 2, length: 1 << 40},
+		{id: 1, chunks: 0, length: 0},
+	} {
+		srv.lock.Lock()
+		srv.store("forged", cm.encode(), flagChunked, 0)
+		srv.lock.Unlock()
+		_, _, _, err := c.Get("forged")
+		assertEqualf(t, ErrNotFound, err, "forged manifest %+v should be a miss: %v", cm, err)
+	}
+
+	// chunks of a failed write are deleted
+	cas, err := c.Set("big", testChunkedValue(), 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	n := len(srv.keys())
+	_, err = c.Set("big", testChunkedValue(), 0, 0, cas+1)
+	assertEqualf(t, ErrKeyExists, err, "expected CAS mismatch: %v", err)
+	assertEqualf(t, n, len(srv.keys()), "chunks of the failed write should be deleted")
+}
+
+func TestReservedFlags(t *testing.T) {
+	c := newFakeCluster().client("a", DefaultConfig())
+
+	_, err := c.Set("foo", "bar", flagChunked, 0, 0)
+	assertEqualf(t, ErrReservedFlags, err, "reserved flags should be rejected: %v", err)
+
+	// with RawFlags, all the bits are the caller's
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.RawFlags = true
+	c = fc.client("a", config)
+	_, err = c.Set("foo", "bar", flagChunked|flagEncrypted, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "value shouldn't be interpreted: %v", v)
+	assertEqualf(t, flagChunked|flagEncrypted, f, "wrong flags: %v", f)
+	_, err = c.SetObject("obj", 1, 0, 0, 0)
+	assertEqualf(t, ErrRawFlags, err, "SetObject should be refused: %v", err)
+
+	config.ChunkSize = 1000
+	_, err = fc.client("a", config).Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, ErrRawFlags, err, "chunking should be refused: %v", err)
+}
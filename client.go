@@ -4,6 +4,9 @@ package mc
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -60,6 +63,15 @@ import (
 type Client struct {
 	servers []*server
 	config  *Config
+	metrics *clientMetrics
+	loads   loadGroup
+	near    *nearCache
+	hot     *hotKeys
+	hedge   *hedger
+
+	// gutter servers take the keys of dead servers
+	gutter       []*server
+	gutterHasher hasher
 }
 
 // NewMC creates a new client with the default configuration. For the default
@@ -76,7 +88,16 @@ func NewMCwithConfig(servers, username, password string, config *Config) *Client
 // newMockableMC creates a new client for testing that allows to mock the server
 // connection
 func newMockableMC(servers, username, password string, config *Config, newMcConn connGen) *Client {
-	client := &Client{config: config}
+	client := &Client{config: config, metrics: &clientMetrics{}}
+	if config.NearCacheSize > 0 {
+		client.near = newNearCache(config.NearCacheSize, config.NearCacheTTL, client.metrics)
+	}
+	if config.HotKeyThreshold > 0 {
+		client.hot = newHotKeys(config)
+	}
+	if config.HedgeDelay > 0 {
+		client.hedge = newHedger(config)
+	}
 
 	s := func(r rune) bool {
 		return r == ',' || r == ';' || r == ' '
@@ -89,11 +110,49 @@ func newMockableMC(servers, username, password string, config *Config, newMcConn
 
 	client.config.Hasher.update(client.servers)
 
+	for _, addr := range strings.FieldsFunc(config.GutterServers, s) {
+		gs := newServer(addr, username, password, config, newMcConn)
+		gs.gutter = true
+		client.gutter = append(client.gutter, gs)
+	}
+	client.gutterHasher = NewModuloHasher()
+	client.gutterHasher.update(client.gutter)
+
 	return client
 }
 
 func (c *Client) perform(m *msg) error {
-	// failover on error
+	if err := c.prepareKey(m); err != nil {
+		return err
+	}
+	// the key of the response isn't the one requested
+	key := m.key
+	if !plainRead(m) {
+		err := c.performKey(m)
+		c.hot.invalidate(key)
+		return err
+	}
+	hot := c.hot.record(key)
+	if hot && c.hot.get(m, c.metrics) {
+		return nil
+	}
+	gen := c.hot.generation(key)
+	err := c.performRead(m)
+	if err == nil && hot {
+		c.hot.put(key, m, gen)
+	}
+	return err
+}
+
+// performKey performs m on the server(s) holding its key.
+func (c *Client) performKey(m *msg) error {
+	if c.replicated(m) {
+		return c.performReplicated(m)
+	}
+
+	// failover on error, as with retries only for operations that can safely
+	// be applied twice: the failed server may have applied it
+	req := *m
 	for {
 		s, err := c.getServer(m.key)
 		if err != nil {
@@ -102,25 +161,78 @@ func (c *Client) perform(m *msg) error {
 		err = s.perform(m)
 		if err != nil && err.(*Error).Status == StatusNetworkError && c.config.Failover {
 			// Failover on network errors
-			if s.changeAlive(false) {
-				go c.wakeUp(s)
+			c.markDown(s, err)
+			if m.streaming() || !idempotent(m.Op) {
+				// the stream may have been partially consumed
+				return err
 			}
+			*m = req
 			continue
 		}
 		return err
 	}
 }
 
+// performBatch pipelines several requests, sending all requests for a given
+// server at once and the batches for different servers in parallel. The status
+// of each request is stored in its ResvOrStatus field. Batches aren't retried
+// nor failed over, the first network error encountered is returned. With
+// replication, quiet sets are copied to the replicas, ignoring their status.
+func (c *Client) performBatch(ms []*msg) error {
+	batches := make(map[*server][]*msg)
+	for _, m := range ms {
+		if err := c.prepareKey(m); err != nil {
+			return err
+		}
+		n := 1
+		if c.config.Replicas > 1 && (m.Op == opSetQ || m.Op == opDeleteQ) {
+			n = c.config.Replicas
+		}
+		servers, err := c.getServers(m.key, n)
+		if err != nil {
+			return err
+		}
+		c.hot.invalidate(m.key)
+		batches[servers[0]] = append(batches[servers[0]], m)
+		for _, s := range servers[1:] {
+			replica := *m
+			batches[s] = append(batches[s], &replica)
+		}
+	}
+
+	errs := make(chan error, len(batches))
+	for s, batch := range batches {
+		go func(s *server, batch []*msg) {
+			err := s.performBatch(batch)
+			c.markDown(s, err)
+			errs <- err
+		}(s, batch)
+	}
+
+	var err error
+	for range batches {
+		if bErr := <-errs; bErr != nil && err == nil {
+			err = bErr
+		}
+	}
+	return err
+}
+
 func (c *Client) wakeUp(s *server) {
 	time.Sleep(c.config.DownRetryDelay)
 	s.changeAlive(true)
 }
 
 func (c *Client) getServer(key string) (*server, error) {
-	idx, err := c.config.Hasher.getServerIndex(key)
+	idx, err := c.config.Hasher.getServerIndex(c.hashKey(key))
 	if err != nil {
 		return nil, err
 	}
+	if len(c.gutter) > 0 && !c.servers[idx].isAlive {
+		if s, ok := c.gutterServer(key); ok {
+			return s, nil
+		}
+	}
 	nServers := uint(len(c.servers))
 	for i := uint(0); i < nServers; i++ {
 		s := c.servers[(idx+i)%nServers]
@@ -136,7 +248,15 @@ func (c *Client) Get(key string) (val string, flags uint32, cas uint64, err erro
 	// Variants: [R] Get [Q, K, KQ]
 	// Request : MUST key; MUST NOT value, extras
 	// Response: MAY key, value, extras ([0..3] flags)
-	return c.getCAS(key, 0)
+	if val, flags, cas, ok := c.near.get(key); ok {
+		return val, flags, cas, nil
+	}
+	gen := c.near.generation(key)
+	val, flags, cas, err = c.getCAS(key, 0)
+	if err == nil {
+		c.near.put(key, val, flags, cas, 0, gen)
+	}
+	return val, flags, cas, err
 }
 
 // getCAS retrieves a value in the cache but only if the CAS specified matches
@@ -146,6 +266,19 @@ func (c *Client) Get(key string) (val string, flags uint32, cas uint64, err erro
 // testing purposes, to be able to test that a memcache server obeys the proper
 // semantics of ignoring CAS with GETs.
 func (c *Client) getCAS(key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
+	val, flags, cas, err = c.getRaw(key, ocas)
+	return val, c.userFlags(flags), cas, err
+}
+
+// getRaw is getCAS but returns the flags as stored, including the bits
+// reserved by the client.
+func (c *Client) getRaw(key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
+	val, flags, cas, err = c.getValue(key, ocas)
+	return stripFetchMeta(val, flags&c.reservedFlags()), flags, cas, err
+}
+
+// getValue is getRaw but keeps the metadata of values set by XFetch.
+func (c *Client) getValue(key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
 	m := &msg{
 		header: header{
 			Op:  opGet,
@@ -156,12 +289,89 @@ func (c *Client) getCAS(key string, ocas uint64) (val string, flags uint32, cas
 	}
 
 	err = c.perform(m)
-	if c.config.Compression.Decompress != nil && err == nil {
-		m.val, err = c.config.Compression.Decompress(m.val)
+	reserved := flags & c.reservedFlags()
+	if err == nil && reserved&flagChunked != 0 {
+		m.val, err = c.joinChunks(key, m.val, opGetKQ, 0)
+	}
+	if err == nil {
+		m.val, err = c.decodeValue(key, m.val, reserved)
 	}
 	return m.val, flags, m.CAS, err
 }
 
+// getCounter retrieves the value of a counter of Incr and Decr, which is never
+// encoded.
+func (c *Client) getCounter(key string) (val string, cas uint64, err error) {
+	var flags uint32
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{&flags},
+		key:     key,
+	}
+
+	err = c.perform(m)
+	return m.val, m.CAS, err
+}
+
+// setCounter sets the counter key to n, stored as Incr and Decr do.
+func (c *Client) setCounter(key string, n uint64) error {
+	m := &msg{
+		header: header{
+			Op: opSet,
+		},
+		iextras: []interface{}{uint32(0), uint32(0)},
+		key:     key,
+		val:     strconv.FormatUint(n, 10),
+	}
+
+	err := c.perform(m)
+	c.near.invalidate(key)
+	return err
+}
+
+// GetTo retrieves a value from the cache and writes it to w as it is read from
+// the server, without holding the whole value in memory. Values chunked or
+// encoded by the client (see flags.go) aren't written and ErrNotStreamable is
+// returned, read them with Get. It is returned as well with Encryption set.
+// Streamed requests are not retried, and if w fails the value is only
+// partially written.
+func (c *Client) GetTo(key string, w io.Writer) (flags uint32, cas uint64, err error) {
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{&flags},
+		key:     key,
+	}
+	// the flags are received before the value, so it's refused before any of
+	// it is written
+	if c.config.Encryption != nil {
+		return 0, 0, ErrNotStreamable
+	}
+	encoded := c.reservedFlags() &^ flagsCodec
+	m.valWriter = writerFunc(func(p []byte) (int, error) {
+		if flags&encoded != 0 {
+			return 0, ErrNotStreamable
+		}
+		return w.Write(p)
+	})
+
+	err = c.perform(m)
+	if flags&encoded != 0 {
+		err = ErrNotStreamable
+	}
+	return c.userFlags(flags), m.CAS, err
+}
+
+// writerFunc is an io.Writer calling itself.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
 // GAT (get and touch) retrieves the value associated with the key and updates
 // its expiration time.
 func (c *Client) GAT(key string, exp uint32) (val string, flags uint32, cas uint64, err error) {
@@ -177,8 +387,23 @@ func (c *Client) GAT(key string, exp uint32) (val string, flags uint32, cas uint
 		key:     key,
 	}
 
+	gen := c.near.generation(key)
 	err = c.perform(m)
-	return m.val, flags, m.CAS, err
+	reserved := flags & c.reservedFlags()
+	if err == nil && reserved&flagChunked != 0 {
+		// touch the chunks as well so they don't expire before the manifest
+		m.val, err = c.joinChunks(key, m.val, opGATKQ, exp)
+	}
+	if err == nil {
+		m.val, err = c.decodeValue(key, m.val, reserved)
+	}
+	m.val = stripFetchMeta(m.val, reserved)
+	if err == nil {
+		c.near.put(key, m.val, c.userFlags(flags), m.CAS, exp, gen)
+	} else {
+		c.near.invalidate(key)
+	}
+	return m.val, c.userFlags(flags), m.CAS, err
 }
 
 // Touch updates the expiration time on a key/value pair in the cache.
@@ -195,6 +420,7 @@ func (c *Client) Touch(key string, exp uint32) (cas uint64, err error) {
 	}
 
 	err = c.perform(m)
+	c.near.invalidate(key)
 	return m.CAS, err
 }
 
@@ -218,29 +444,78 @@ func (c *Client) Add(key, val string, flags, exp uint32) (cas uint64, err error)
 	return c.setGeneric(opAdd, key, val, 0, flags, exp)
 }
 
+// SetFrom sets a key/value pair in the cache, reading the size bytes of the
+// value from r as they are sent to the server, without holding the whole value
+// in memory. The value is stored as read, i.e. it is never compressed,
+// encrypted, checksummed or chunked (whatever ChunkSize), so it must fit in an
+// item of the server, and ErrNotStreamable is returned with Encryption set.
+// Streamed requests are not retried.
+func (c *Client) SetFrom(key string, r io.Reader, size int64, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	// Variants: [R] Set [Q]
+	m := &msg{
+		header: header{
+			Op:  opSet,
+			CAS: ocas,
+		},
+		iextras:   []interface{}{flags, exp},
+		key:       key,
+		valReader: r,
+		valLen:    size,
+	}
+	if flags&c.reservedFlags() != 0 {
+		return 0, ErrReservedFlags
+	}
+	if c.config.Encryption != nil {
+		return 0, ErrNotStreamable
+	}
+	if size < 0 || size > math.MaxUint32-int64(sizeOfExtras(m.iextras))-int64(len(key)) {
+		return 0, ErrValueTooLarge
+	}
+
+	err = c.perform(m)
+	c.near.invalidate(key)
+	return m.CAS, err
+}
+
 // Set/Add/Replace a key/value pair in the cache.
 func (c *Client) setGeneric(op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
 	// Request : MUST key, value, extras ([0..3] flags, [4..7] expiration)
 	// Response: MUST NOT key, value, extras
 	// CAS: If a CAS is specified (non-zero), all sets only succeed if the key
 	//      exists and has the CAS specified. Otherwise, an error is returned.
+	if flags&c.reservedFlags() != 0 {
+		return 0, ErrReservedFlags
+	}
+	return c.store(op, key, val, ocas, flags, exp)
+}
+
+// store is setGeneric but accepts flags using the bits reserved by the client.
+func (c *Client) store(op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
 	m := &msg{
 		header: header{
 			Op:  op,
 			CAS: ocas,
 		},
-		iextras: []interface{}{flags, exp},
-		key:     key,
-		val:     val,
+		key: key,
 	}
-	if c.config.Compression.Compress != nil {
-		m.val, err = c.config.Compression.Compress(m.val)
-		if err != nil {
-			return m.CAS, err
-		}
+	m.val, flags, err = c.encodeValue(key, val, flags)
+	if err != nil {
+		return 0, err
 	}
-	err = c.perform(m)
-	return m.CAS, err
+	m.iextras = []interface{}{flags, exp}
+	gen := c.near.generation(key)
+	if c.config.ChunkSize > 0 && len(m.val) > c.config.ChunkSize {
+		cas, err = c.setChunked(m)
+	} else {
+		err = c.perform(m)
+		cas = m.CAS
+	}
+	if err == nil {
+		c.near.put(key, stripFetchMeta(val, flags), c.userFlags(flags), cas, exp, gen)
+	} else {
+		c.near.invalidate(key)
+	}
+	return cas, err
 }
 
 // Incr increments a value in the cache. The value must be an unsigned 64bit
@@ -278,6 +553,7 @@ func (c *Client) incrdecr(op opCode, key string, delta, init uint64, exp uint32,
 	}
 
 	err = c.perform(m)
+	c.near.invalidate(key)
 	if err != nil {
 		return
 	}
@@ -312,6 +588,7 @@ func (c *Client) Append(key, val string, ocas uint64) (cas uint64, err error) {
 	}
 
 	err = c.perform(m)
+	c.near.invalidate(key)
 	return m.CAS, err
 }
 
@@ -331,6 +608,7 @@ func (c *Client) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
 	}
 
 	err = c.perform(m)
+	c.near.invalidate(key)
 	return m.CAS, err
 }
 
@@ -353,7 +631,9 @@ func (c *Client) DelCAS(key string, cas uint64) (err error) {
 		key: key,
 	}
 
-	return c.perform(m)
+	err = c.perform(m)
+	c.near.invalidate(key)
+	return err
 }
 
 // Flush flushes the cache, that is, invalidate all keys. Note, this doesn't
@@ -375,12 +655,14 @@ func (c *Client) Flush(when uint32) (err error) {
 		iextras: []interface{}{when},
 	}
 
-	for _, s := range c.servers {
+	c.hot.clear()
+	for _, s := range c.allServers() {
 		if s.isAlive {
 			var ms msg = *m
 			err = s.perform(&ms)
 		}
 	}
+	c.near.clear()
 	return err // retrns err from last perform but maybe should handle differently
 }
 
@@ -443,7 +725,7 @@ func (c *Client) Quit() {
 		},
 	}
 
-	for _, s := range c.servers {
+	for _, s := range c.allServers() {
 		var ms msg = *m
 		s.quit(&ms)
 	}
@@ -0,0 +1,63 @@
+package mc
+
+import (
+	"testing"
+)
+
+type testObject struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestObjectCodecs(t *testing.T) {
+	fc := newFakeCluster()
+	obj := testObject{Name: "foo", Count: 42, Tags: []string{"a", "b"}}
+
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		config := DefaultConfig()
+		config.Codec = codec
+		c := fc.client("a", config)
+
+		_, err := c.SetObject("obj", obj, 7, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+		// decoded by a reader configured with a different codec
+		var got testObject
+		flags, _, err := fc.client("a", DefaultConfig()).GetObject("obj", &got)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, obj, got, "wrong object decoded with codec %d", codec.ID())
+		assertEqualf(t, uint32(7), flags, "wrong flags: %v", flags)
+
+		// codec bits don't leak into plain gets
+		_, flags, _, err = c.Get("obj")
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, uint32(7), flags, "wrong flags: %v", flags)
+	}
+
+	config := DefaultConfig()
+	config.Codec = RawCodec
+	c := fc.client("a", config)
+	_, err := c.SetObject("raw", []byte("bar"), 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	var s string
+	_, _, err = c.GetObject("raw", &s)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", s, "wrong value: %s", s)
+}
+
+func TestObjectUnknownCodec(t *testing.T) {
+	c := newFakeCluster().client("a", DefaultConfig())
+
+	// plain values aren't mis-parsed
+	_, err := c.Set("plain", `{"Name":"foo"}`, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	var got testObject
+	_, _, err = c.GetObject("plain", &got)
+	assertEqualf(t, ErrUnknownCodec, err, "expected unknown codec: %v", err)
+
+	_, _, err = c.GetObject("missing", &got)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+
+	assertNotEqualf(t, nil, RegisterCodec(GobCodec), "registering an ID twice should fail")
+}
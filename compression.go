@@ -0,0 +1,363 @@
+package mc
+
+// Compression of values.
+//
+// Values of at least Config.Compression.Threshold bytes are compressed with
+// Config.Compression.Compressor, and stored compressed only if that makes them
+// smaller. The ID of the compressor is recorded in the flags of compressed
+// values, so they are decompressed based on that marker: compression can be
+// enabled, disabled or changed on a live cluster without breaking reads of
+// values already stored.
+//
+// The legacy Config.Compression.Compress and Decompress functions don't mark
+// values. Compress is only used if no Compressor is set, while Decompress is
+// applied to all unmarked values, which allows migrating to a Compressor: set
+// both, and remove Decompress once the values written by Compress expired.
+// During the migration, unmarked values can't be told apart from values a
+// Compressor didn't compress (below Threshold or incompressible), so unmarked
+// values Decompress fails on are returned as stored. Without a Compressor, its
+// errors are returned.
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Compressor compresses values stored in the cache.
+type Compressor interface {
+	// ID identifies the compressor in the flags of stored values. IDs 1 to 4
+	// are used by the built-in compressors, custom ones may use 5 to 15.
+	ID() uint8
+	Compress(value string) (string, error)
+	Decompress(value string) (string, error)
+}
+
+// Built-in compressors.
+var (
+	// ZlibCompressor compresses values with compress/zlib.
+	ZlibCompressor Compressor = &streamCompressor{
+		id: 1,
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	}
+	// GzipCompressor compresses values with compress/gzip.
+	GzipCompressor Compressor = &streamCompressor{
+		id: 2,
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+	// FlateCompressor compresses values with compress/flate.
+	FlateCompressor Compressor = &streamCompressor{
+		id: 3,
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+	// LZCompressor is a fast LZ77 compressor in the spirit of LZ4 (but not
+	// compatible with it), trading compression ratio for speed.
+	LZCompressor Compressor = lzCompressor{}
+)
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[uint8]Compressor{
+		ZlibCompressor.ID():  ZlibCompressor,
+		GzipCompressor.ID():  GzipCompressor,
+		FlateCompressor.ID(): FlateCompressor,
+		LZCompressor.ID():    LZCompressor,
+	}
+)
+
+// RegisterCompressor makes a custom compressor available to decompress values
+// read from the cache. Only one compressor can be registered for a given ID.
+func RegisterCompressor(compressor Compressor) error {
+	id := compressor.ID()
+	if id == 0 || uint32(id) > flagsCompressor>>flagsCompressorShift {
+		return fmt.Errorf("mc: invalid compressor ID %d", id)
+	}
+
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	if _, ok := compressors[id]; ok {
+		return fmt.Errorf("mc: compressor ID %d already registered", id)
+	}
+	compressors[id] = compressor
+	return nil
+}
+
+// lookupCompressor returns the compressor registered for id.
+func lookupCompressor(id uint8) (Compressor, bool) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	compressor, ok := compressors[id]
+	return compressor, ok
+}
+
+// compress compresses val as configured and returns the flags to store along
+// with it.
+func (c *Client) compress(val string, flags uint32) (string, uint32, error) {
+	compressor := c.config.Compression.Compressor
+	if compressor == nil {
+		if c.config.Compression.Compress != nil {
+			cval, err := c.config.Compression.Compress(val)
+			if err != nil {
+				return val, flags, wrapError(StatusUnknownError, err)
+			}
+			return cval, flags, nil
+		}
+		return val, flags, nil
+	}
+
+	if len(val) < c.config.Compression.Threshold {
+		return val, flags, nil
+	}
+	cval, err := compressor.Compress(val)
+	if err != nil {
+		return val, flags, wrapError(StatusUnknownError, err)
+	}
+	if len(cval) >= len(val) {
+		// not worth it
+		return val, flags, nil
+	}
+	return cval, flags | compressorFlags(compressor.ID()), nil
+}
+
+// decompress decompresses val according to flags.
+func (c *Client) decompress(val string, flags uint32) (string, error) {
+	id := compressorID(flags)
+	if id == 0 {
+		if c.config.Compression.Decompress == nil {
+			return val, nil
+		}
+		dval, err := c.config.Compression.Decompress(val)
+		if err != nil {
+			if c.config.Compression.Compressor != nil {
+				// not written by the legacy Compress
+				return val, nil
+			}
+			return "", wrapError(StatusUnknownError, err)
+		}
+		return dval, nil
+	}
+
+	compressor, ok := lookupCompressor(id)
+	if !ok {
+		return "", ErrUnknownCompressor
+	}
+	val, err := compressor.Decompress(val)
+	if err != nil {
+		return "", wrapError(StatusUnknownError, err)
+	}
+	return val, nil
+}
+
+// streamCompressor is a Compressor using a compress/* package.
+type streamCompressor struct {
+	id        uint8
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (sc *streamCompressor) ID() uint8 {
+	return sc.id
+}
+
+func (sc *streamCompressor) Compress(value string) (string, error) {
+	var buf bytes.Buffer
+	w, err := sc.newWriter(&buf)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.WriteString(w, value); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (sc *streamCompressor) Decompress(value string) (string, error) {
+	r, err := sc.newReader(strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// The LZ format is the uncompressed length as a uvarint followed by a number
+// of sequences, each made of:
+//   - a token byte: literal length in the high nibble, match length minus
+//     lzMinMatch in the low nibble. 15 means more length bytes follow, each
+//     adding up to 255, until a byte below 255.
+//   - extra literal length bytes, then the literals.
+//   - the match offset (2 bytes, little endian), then extra match length bytes.
+//
+// The last sequence ends after its literals and has no match.
+const (
+	lzMinMatch  = 4
+	lzMaxOffset = 1<<16 - 1
+	lzHashLog   = 14
+)
+
+var errLZCorrupt = errors.New("mc: corrupt LZ compressed value")
+
+type lzCompressor struct{}
+
+func (lzCompressor) ID() uint8 {
+	return 4
+}
+
+func (lzCompressor) Compress(value string) (string, error) {
+	src := []byte(value)
+	dst := make([]byte, binary.MaxVarintLen64, len(src)+len(src)/255+16)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	var table [1 << lzHashLog]int32 // position + 1 of the last occurrence of a hash
+	anchor := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lzHashLog)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > lzMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != seq {
+			i++
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length < len(src) && src[cand+length] == src[i+length] {
+			length++
+		}
+		dst = lzAppendSequence(dst, src[anchor:i], i-cand, length)
+		i += length
+		anchor = i
+	}
+	dst = lzAppendSequence(dst, src[anchor:], 0, 0)
+	return string(dst), nil
+}
+
+// lzAppendSequence appends a sequence to dst, without match if offset is 0.
+func lzAppendSequence(dst, literals []byte, offset, length int) []byte {
+	litLen := len(literals)
+	matchLen := length - lzMinMatch
+	token := byte(min15(litLen)) << 4
+	if offset > 0 {
+		token |= byte(min15(matchLen))
+	}
+	dst = append(dst, token)
+	dst = lzAppendLength(dst, litLen)
+	dst = append(dst, literals...)
+	if offset > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		dst = lzAppendLength(dst, matchLen)
+	}
+	return dst
+}
+
+func min15(n int) int {
+	if n > 15 {
+		return 15
+	}
+	return n
+}
+
+// lzAppendLength appends the extra bytes of a length that didn't fit a nibble.
+func lzAppendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func (lzCompressor) Decompress(value string) (string, error) {
+	src := []byte(value)
+	n, i := binary.Uvarint(src)
+	// a byte of input can't decode to more than 255 bytes
+	if i <= 0 || n > uint64(len(src))*255 {
+		return "", errLZCorrupt
+	}
+	dst := make([]byte, 0, n)
+
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		litLen, ok := lzReadLength(src, &i, int(token>>4))
+		if !ok || litLen > len(src)-i {
+			return "", errLZCorrupt
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return "", errLZCorrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		matchLen, ok := lzReadLength(src, &i, int(token&15))
+		if !ok || offset == 0 || offset > len(dst) {
+			return "", errLZCorrupt
+		}
+		matchLen += lzMinMatch
+		if uint64(len(dst)+matchLen) > n {
+			return "", errLZCorrupt
+		}
+		// copy byte by byte as the match may overlap the bytes it produces
+		for start := len(dst) - offset; matchLen > 0; matchLen-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return "", errLZCorrupt
+	}
+	return string(dst), nil
+}
+
+// lzReadLength reads the extra bytes of a length whose nibble is n.
+func lzReadLength(src []byte, i *int, n int) (int, bool) {
+	if n < 15 {
+		return n, true
+	}
+	for {
+		if *i >= len(src) {
+			return 0, false
+		}
+		b := src[*i]
+		*i++
+		n += int(b)
+		if b < 255 {
+			return n, true
+		}
+	}
+}
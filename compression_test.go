@@ -0,0 +1,140 @@
+package mc
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func testCompressionInputs() []string {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return []string{
+		"",
+		"a",
+		"abcd",
+		strings.Repeat("a", 100000),
+		strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit. ", 200),
+		string(random),
+		strings.Repeat(string(random[:300]), 10) + "end",
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	for _, compressor := range []Compressor{ZlibCompressor, GzipCompressor, FlateCompressor, LZCompressor} {
+		for _, in := range testCompressionInputs() {
+			c, err := compressor.Compress(in)
+			assertEqualf(t, nil, err, "compressor %d: unexpected error: %v", compressor.ID(), err)
+			out, err := compressor.Decompress(c)
+			assertEqualf(t, nil, err, "compressor %d: unexpected error: %v", compressor.ID(), err)
+			assertTruef(t, in == out, "compressor %d: round trip failed for %d bytes", compressor.ID(), len(in))
+		}
+	}
+
+	c, _ := LZCompressor.Compress(strings.Repeat("abc", 1000))
+	assertTruef(t, len(c) < 100, "LZ should compress repetitive input: %d bytes", len(c))
+}
+
+func TestLZCorrupt(t *testing.T) {
+	c, _ := LZCompressor.Compress(strings.Repeat("Lorem ipsum dolor sit amet. ", 100))
+	inputs := []string{"", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff", c[:len(c)/2], c + "x", "\x05\x10a"}
+	for _, in := range inputs {
+		_, err := LZCompressor.Decompress(in)
+		assertNotEqualf(t, nil, err, "corrupt input should fail: %q", in)
+	}
+}
+
+func TestCompressionLegacy(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Compression.Compress = func(value string) (string, error) {
+		return "z:" + value, nil
+	}
+	config.Compression.Decompress = func(value string) (string, error) {
+		if !strings.HasPrefix(value, "z:") {
+			return "", errors.New("not compressed")
+		}
+		return value[2:], nil
+	}
+	c := fc.client("a", config)
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ := fc.server("a").get("foo")
+	assertEqualf(t, "z:bar", it.val, "value should be compressed")
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+
+	// errors are returned as *Error
+	_, err = fc.client("a", DefaultConfig()).Set("plain", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("plain")
+	mcErr, ok := err.(*Error)
+	assertTruef(t, ok && mcErr.Status == StatusUnknownError, "wrong error: %#v", err)
+
+	// while migrating to a Compressor, legacy values are still decompressed,
+	// and values the Compressor left uncompressed are read as stored
+	config.Compression.Compressor = LZCompressor
+	c = fc.client("a", config)
+	v, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "legacy value should be decompressed: %v", v)
+	_, err = c.Set("small", "hi", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = c.Get("small")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "hi", v, "wrong value: %v", v)
+
+	// marked values are decompressed whatever the reader's configuration
+	big := strings.Repeat("Lorem ipsum dolor sit amet. ", 100)
+	_, err = c.Set("big", big, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = fc.client("a", DefaultConfig()).Get("big")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, v == big, "marked value should be decompressed")
+}
+
+func TestCompressionMarked(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Compression.Compressor = LZCompressor
+	config.Compression.Threshold = 100
+	c := fc.client("a", config)
+
+	const FLAGS uint32 = 42
+	big := strings.Repeat("Lorem ipsum dolor sit amet. ", 100)
+
+	_, err := c.Set("small", "bar", FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set("big", big, FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	it, _ := fc.server("a").get("small")
+	assertEqualf(t, "bar", it.val, "value below threshold shouldn't be compressed")
+	assertEqualf(t, FLAGS, it.flags, "value below threshold shouldn't be marked")
+	it, _ = fc.server("a").get("big")
+	assertTruef(t, len(it.val) < len(big), "value should be compressed")
+	assertEqualf(t, LZCompressor.ID(), compressorID(it.flags), "value should be marked")
+
+	// a reader without compression configured decompresses marked values
+	reader := fc.client("a", DefaultConfig())
+	for _, key := range []string{"small", "big"} {
+		v, f, _, err := reader.Get(key)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+		assertTruef(t, v == "bar" || v == big, "wrong value for %s", key)
+	}
+	v, f, _, err := reader.GAT("big", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertTruef(t, v == big, "GAT should decompress")
+
+	// incompressible values are stored as is
+	random := testCompressionInputs()[5]
+	_, err = c.Set("random", random, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ = fc.server("a").get("random")
+	assertEqualf(t, uint32(0), it.flags, "incompressible value shouldn't be marked")
+}
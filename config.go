@@ -9,10 +9,16 @@ import (
 // Config holds the Memcache client configuration. Use DefaultConfig to get
 // an initialized version.
 type Config struct {
-	Hasher     hasher
-	Retries    int
-	RetryDelay time.Duration
-	Failover   bool
+	Hasher hasher
+	// Retries is the number of times requests of idempotent operations failing
+	// with a network error are tried, waiting RetryDelay between attempts,
+	// unless RetryPolicy is set (see RetryPolicy).
+	Retries     int
+	RetryDelay  time.Duration
+	RetryPolicy RetryPolicy
+	// Failover marks a server failing with a network error as down and sends
+	// requests of idempotent operations to the next server instead.
+	Failover bool
 	// ConnectionTimeout is currently used to timeout getting connections from
 	// pool, as a sending deadline and as a reading deadline. Worst case this
 	// means a request can take 3 times the ConnectionTimeout.
@@ -22,9 +28,102 @@ type Config struct {
 	TcpKeepAlive       bool
 	TcpKeepAlivePeriod time.Duration
 	TcpNoDelay         bool
-	Compression        struct {
+	// ChunkSize enables storing values larger than ChunkSize bytes (after
+	// compression) split across several keys, for values exceeding the server's
+	// item size limit. It should leave some room below the limit for the item
+	// overhead. Chunked values are read back transparently by any client,
+	// whatever its ChunkSize. 0 disables chunking.
+	ChunkSize int
+	// KeyTransformer, if set, is applied to all keys before they are validated
+	// and sent to the server, e.g. DigestKey to make arbitrary keys safe.
+	KeyTransformer func(key string) string
+	// Codec is used by SetObject to encode values.
+	Codec Codec
+	// RawFlags leaves all the bits of the flags to the caller, for
+	// applications already using the upper 12 bits. The client then neither
+	// reserves nor interprets them, and the features recording themselves in
+	// the flags (ChunkSize, Encryption, Checksum, Compression.Compressor,
+	// SetObject, GetObject and the metadata of XFetch) return ErrRawFlags.
+	RawFlags bool
+	// Encryption, if set, enables the encryption of values with the keys of
+	// the key ring.
+	Encryption *KeyRing
+	// Checksum enables storing values along with a checksum and SchemaVersion,
+	// verified by readers. Values with a different SchemaVersion are read as
+	// misses.
+	Checksum      bool
+	SchemaVersion uint16
+	// LoadLockTTL enables coalescing the loads of GetOrLoad across processes
+	// with a lock held in the cache for at most LoadLockTTL (rounded up to
+	// the second). 0 disables the lock.
+	LoadLockTTL time.Duration
+	// XFetchBeta scales how early XFetch recomputes values before they
+	// expire: above 1 favors earlier recomputations, below 1 later ones.
+	XFetchBeta float64
+	// NearCacheSize enables an in-process cache of up to NearCacheSize bytes
+	// in front of Get, keeping values for up to NearCacheTTL. 0 disables it.
+	NearCacheSize int
+	NearCacheTTL  time.Duration
+	// UpdateRetries is the number of times Update retries on conflicts,
+	// waiting a random backoff of up to UpdateBackoff, doubled on each retry.
+	UpdateRetries int
+	UpdateBackoff time.Duration
+	// Replicas is the number of servers each key is stored on. Writes go to
+	// all of them and succeed once WriteQuorum servers succeeded (all of them
+	// if 0), reads fall back to the replicas on misses and errors. Conditional
+	// writes (CAS, Add, Replace) succeed once applied on the first server.
+	// Quiet sets and deletes of batches are copied to the replicas without
+	// quorum or failover.
+	Replicas    int
+	WriteQuorum int
+	// ReadRepairRate is the fraction of Get hits on replicated keys after
+	// which the copies on other replicas are checked and repaired in the
+	// background. Repaired copies expire after ReadRepairTTL seconds.
+	ReadRepairRate float64
+	ReadRepairTTL  uint32
+	// GutterServers is a list of servers, in the same format as the main
+	// list, taking the keys of dead servers (instead of the next server in
+	// the main list), with expirations limited to GutterTTL seconds.
+	GutterServers string
+	GutterTTL     uint32
+	// HashTags makes keys containing a substring enclosed in braces, e.g.
+	// "{user:42}:profile", choose their server by that substring only (after
+	// KeyTransformer), so related keys are stored on the same server.
+	HashTags bool
+	// LocalZone is the availability zone of the client. Reads of replicated
+	// keys go to the replicas in the same zone (set with the zone option of
+	// servers, e.g. "host:11211?zone=eu-west-1a") first.
+	LocalZone string
+	// HotKeyThreshold enables the detection of hot keys (see HotKeys): keys
+	// read at least HotKeyThreshold times per HotKeyWindow, as estimated from
+	// a sample of HotKeySampleRate of the reads.
+	HotKeyThreshold  uint64
+	HotKeySampleRate float64
+	HotKeyWindow     time.Duration
+	// HotKeyCacheSize is the size in bytes of a local cache serving hot keys
+	// for up to HotKeyCacheTTL. 0 disables it.
+	HotKeyCacheSize int
+	HotKeyCacheTTL  time.Duration
+	// HotKeyFanout spreads the reads of hot keys across their replicas (see
+	// Replicas) instead of reading them from the primary first.
+	HotKeyFanout bool
+	// HedgeDelay enables hedged reads: a Get not answered within HedgeDelay
+	// is sent again to a replica (or over another connection), and the first
+	// reply is returned. With HedgePercentile set (e.g. 0.95), the delay is
+	// that percentile of the latencies of recent reads, but at least
+	// HedgeDelay. HedgeBudget caps the hedges to that fraction of the reads.
+	HedgeDelay      time.Duration
+	HedgePercentile float64
+	HedgeBudget     float64
+	// Compression configures the compression of values. Values of at least
+	// Threshold bytes are compressed with Compressor (if set), and marked as
+	// such in their flags. Compress and Decompress are deprecated, they don't
+	// mark values, see Compressor for details.
+	Compression struct {
 		Decompress func(value string) (string, error)
 		Compress   func(value string) (string, error)
+		Compressor Compressor
+		Threshold  int
 	}
 }
 
@@ -36,6 +135,7 @@ The default values currently are:
 		Hasher:             NewModuloHasher(),
 		Retries:            2,
 		RetryDelay:         200 * time.Millisecond,
+		RetryPolicy:        nil,
 		Failover:           true,
 		ConnectionTimeout:  2 * time.Second,
 		DownRetryDelay:     60 * time.Second,
@@ -43,9 +143,41 @@ The default values currently are:
 		TcpKeepAlive:       true,
 		TcpKeepAlivePeriod: 60 * time.Second,
 		TcpNoDelay:         true,
+		ChunkSize:          0,
+		KeyTransformer:     nil,
+		Codec:              JSONCodec,
+		RawFlags:           false,
+		Encryption:         nil,
+		Checksum:           false,
+		SchemaVersion:      0,
+		LoadLockTTL:        0,
+		XFetchBeta:         1,
+		NearCacheSize:      0,
+		NearCacheTTL:       time.Second,
+		UpdateRetries:      10,
+		UpdateBackoff:      5 * time.Millisecond,
+		Replicas:           1,
+		WriteQuorum:        0,
+		ReadRepairRate:     0,
+		ReadRepairTTL:      3600,
+		GutterServers:      "",
+		GutterTTL:          10,
+		HashTags:           false,
+		LocalZone:          "",
+		HotKeyThreshold:    0,
+		HotKeySampleRate:   0.01,
+		HotKeyWindow:       10 * time.Second,
+		HotKeyCacheSize:    0,
+		HotKeyCacheTTL:     time.Second,
+		HotKeyFanout:       false,
+		HedgeDelay:         0,
+		HedgePercentile:    0,
+		HedgeBudget:        0.05,
 		Compression        struct {
 			Decompress  nil
 			Compress 		nil
+			Compressor  nil
+			Threshold   1024
 		}
 	}
 */
@@ -54,6 +186,7 @@ func DefaultConfig() *Config {
 		Hasher:             NewModuloHasher(),
 		Retries:            2,
 		RetryDelay:         200 * time.Millisecond,
+		RetryPolicy:        nil,
 		Failover:           true,
 		ConnectionTimeout:  2 * time.Second,
 		DownRetryDelay:     60 * time.Second,
@@ -61,9 +194,41 @@ func DefaultConfig() *Config {
 		TcpKeepAlive:       true,
 		TcpKeepAlivePeriod: 60 * time.Second,
 		TcpNoDelay:         true,
+		ChunkSize:          0,
+		KeyTransformer:     nil,
+		Codec:              JSONCodec,
+		RawFlags:           false,
+		Encryption:         nil,
+		Checksum:           false,
+		SchemaVersion:      0,
+		LoadLockTTL:        0,
+		XFetchBeta:         1,
+		NearCacheSize:      0,
+		NearCacheTTL:       time.Second,
+		UpdateRetries:      10,
+		UpdateBackoff:      5 * time.Millisecond,
+		Replicas:           1,
+		WriteQuorum:        0,
+		ReadRepairRate:     0,
+		ReadRepairTTL:      3600,
+		GutterServers:      "",
+		GutterTTL:          10,
+		HashTags:           false,
+		LocalZone:          "",
+		HotKeyThreshold:    0,
+		HotKeySampleRate:   0.01,
+		HotKeyWindow:       10 * time.Second,
+		HotKeyCacheSize:    0,
+		HotKeyCacheTTL:     time.Second,
+		HotKeyFanout:       false,
+		HedgeDelay:         0,
+		HedgePercentile:    0,
+		HedgeBudget:        0.05,
 		Compression: struct {
 			Decompress func(value string) (string, error)
 			Compress   func(value string) (string, error)
-		}{Decompress: nil, Compress: nil},
+			Compressor Compressor
+			Threshold  int
+		}{Decompress: nil, Compress: nil, Compressor: nil, Threshold: 1024},
 	}
 }
@@ -0,0 +1,465 @@
+package mc
+
+// Migration between clusters.
+//
+// A DualClient wraps the clients of two clusters to migrate from one to the
+// other: writes go to both (the primary first), reads are served by the primary
+// and a sample of them is compared with the secondary in the background. The
+// primary and the secondary can be swapped at runtime.
+//
+// Writes are only sent to the secondary once they succeeded on the primary.
+// Writes conditioned on the current value (a CAS, Add or Replace) are copied
+// unconditionally to the secondary, as CAS values differ between clusters. The
+// errors of the secondary are ignored.
+//
+// Composite methods run on the primary and copy the values they write to the
+// secondary: values loaded by GetOrLoad, computed by XFetch (along with their
+// metadata) or written by Update, and streamed values, read back from the
+// primary. Locks are taken on the primary and copied to the secondary, and the
+// generations of namespaces are copied as well, so both stay valid once the
+// clusters are swapped.
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is the set of key-value methods of Client also implemented by
+// DualClient and Router. Streaming (GetTo, SetFrom), server-wide (Version,
+// Stats, StatsWithKey, StatsReset) and composite (GetOrLoad, XFetch, Update,
+// Lock, Namespace) methods are only implemented by Client and DualClient:
+// reach them through Router.Route.
+type Cache interface {
+	Get(key string) (val string, flags uint32, cas uint64, err error)
+	GAT(key string, exp uint32) (val string, flags uint32, cas uint64, err error)
+	GetObject(key string, v interface{}) (flags uint32, cas uint64, err error)
+	Touch(key string, exp uint32) (cas uint64, err error)
+	Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error)
+	Replace(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error)
+	Add(key, val string, flags, exp uint32) (cas uint64, err error)
+	SetObject(key string, v interface{}, flags, exp uint32, ocas uint64) (cas uint64, err error)
+	Incr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error)
+	Decr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error)
+	Append(key, val string, ocas uint64) (cas uint64, err error)
+	Prepend(key, val string, ocas uint64) (cas uint64, err error)
+	Del(key string) (err error)
+	DelCAS(key string, cas uint64) (err error)
+	Flush(when uint32) (err error)
+	NoOp() (err error)
+	Quit()
+}
+
+var (
+	_ Cache = (*Client)(nil)
+	_ Cache = (*DualClient)(nil)
+)
+
+// ShadowMismatch describes a read whose result differed between the primary
+// and the secondary.
+type ShadowMismatch struct {
+	Key                          string
+	Primary, Secondary           string
+	PrimaryFlags, SecondaryFlags uint32
+	PrimaryErr, SecondaryErr     error
+}
+
+// DualClient writes to two clusters and reads from one of them. It is safe for
+// concurrent use.
+type DualClient struct {
+	lock       sync.RWMutex
+	primary    *Client
+	secondary  *Client
+	shadowRate float64
+	onMismatch func(ShadowMismatch)
+	mismatches uint64
+}
+
+// NewDualClient creates a client writing to primary and secondary and reading
+// from primary.
+func NewDualClient(primary, secondary *Client) *DualClient {
+	return &DualClient{primary: primary, secondary: secondary}
+}
+
+// SetShadowReads makes a fraction rate of the reads by Get and GAT read from
+// the secondary as well in the background, calling onMismatch (if not nil)
+// when the results differ.
+func (d *DualClient) SetShadowReads(rate float64, onMismatch func(ShadowMismatch)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.shadowRate = rate
+	d.onMismatch = onMismatch
+}
+
+// Swap swaps the primary and the secondary.
+func (d *DualClient) Swap() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.primary, d.secondary = d.secondary, d.primary
+}
+
+// Primary returns the client of the primary cluster.
+func (d *DualClient) Primary() *Client {
+	p, _ := d.clients()
+	return p
+}
+
+// Secondary returns the client of the secondary cluster.
+func (d *DualClient) Secondary() *Client {
+	_, s := d.clients()
+	return s
+}
+
+// ShadowMismatches returns the number of shadow reads that didn't match.
+func (d *DualClient) ShadowMismatches() uint64 {
+	return atomic.LoadUint64(&d.mismatches)
+}
+
+func (d *DualClient) clients() (primary, secondary *Client) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.primary, d.secondary
+}
+
+// shadow compares in the background the result of a read from the primary with
+// the one of read from the secondary, for a sample of reads. It returns whether
+// the read was sampled.
+func (d *DualClient) shadow(key, val string, flags uint32, err error, read func() (string, uint32, error)) bool {
+	d.lock.RLock()
+	rate, onMismatch := d.shadowRate, d.onMismatch
+	d.lock.RUnlock()
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+
+	go func() {
+		sval, sflags, serr := read()
+		if val == sval && flags == sflags && err == serr {
+			return
+		}
+		atomic.AddUint64(&d.mismatches, 1)
+		if onMismatch != nil {
+			onMismatch(ShadowMismatch{
+				Key:            key,
+				Primary:        val,
+				Secondary:      sval,
+				PrimaryFlags:   flags,
+				SecondaryFlags: sflags,
+				PrimaryErr:     err,
+				SecondaryErr:   serr,
+			})
+		}
+	}()
+	return true
+}
+
+// Get retrieves a value from the primary. See Client.Get.
+func (d *DualClient) Get(key string) (val string, flags uint32, cas uint64, err error) {
+	p, s := d.clients()
+	val, flags, cas, err = p.Get(key)
+	d.shadow(key, val, flags, err, func() (string, uint32, error) {
+		val, flags, _, err := s.Get(key)
+		return val, flags, err
+	})
+	return val, flags, cas, err
+}
+
+// GAT retrieves a value from the primary and updates its expiration time on
+// both clusters. See Client.GAT.
+func (d *DualClient) GAT(key string, exp uint32) (val string, flags uint32, cas uint64, err error) {
+	p, s := d.clients()
+	val, flags, cas, err = p.GAT(key, exp)
+	// the secondary is always touched, only the comparison is sampled
+	sampled := d.shadow(key, val, flags, err, func() (string, uint32, error) {
+		val, flags, _, err := s.GAT(key, exp)
+		return val, flags, err
+	})
+	if !sampled {
+		s.Touch(key, exp)
+	}
+	return val, flags, cas, err
+}
+
+// GetObject retrieves a value from the primary. See Client.GetObject.
+func (d *DualClient) GetObject(key string, v interface{}) (flags uint32, cas uint64, err error) {
+	p, _ := d.clients()
+	return p.GetObject(key, v)
+}
+
+// Touch updates the expiration time of a key on both clusters. See
+// Client.Touch.
+func (d *DualClient) Touch(key string, exp uint32) (cas uint64, err error) {
+	p, s := d.clients()
+	cas, err = p.Touch(key, exp)
+	s.Touch(key, exp)
+	return cas, err
+}
+
+// Set sets a key/value pair on both clusters. See Client.Set.
+func (d *DualClient) Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.Set(key, val, flags, exp, ocas); err == nil {
+		s.Set(key, val, flags, exp, 0)
+	}
+	return cas, err
+}
+
+// Replace replaces a key/value pair on the primary and copies it to the
+// secondary. See Client.Replace.
+func (d *DualClient) Replace(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.Replace(key, val, flags, exp, ocas); err == nil {
+		s.Set(key, val, flags, exp, 0)
+	}
+	return cas, err
+}
+
+// Add adds a key/value pair on the primary and copies it to the secondary. See
+// Client.Add.
+func (d *DualClient) Add(key, val string, flags, exp uint32) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.Add(key, val, flags, exp); err == nil {
+		s.Set(key, val, flags, exp, 0)
+	}
+	return cas, err
+}
+
+// SetObject sets a value on both clusters. See Client.SetObject.
+func (d *DualClient) SetObject(key string, v interface{}, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.SetObject(key, v, flags, exp, ocas); err == nil {
+		s.SetObject(key, v, flags, exp, 0)
+	}
+	return cas, err
+}
+
+// Incr increments a value on both clusters. See Client.Incr.
+func (d *DualClient) Incr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	p, s := d.clients()
+	if n, cas, err = p.Incr(key, delta, init, exp, ocas); err == nil {
+		s.Incr(key, delta, init, exp, 0)
+	}
+	return n, cas, err
+}
+
+// Decr decrements a value on both clusters. See Client.Decr.
+func (d *DualClient) Decr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	p, s := d.clients()
+	if n, cas, err = p.Decr(key, delta, init, exp, ocas); err == nil {
+		s.Decr(key, delta, init, exp, 0)
+	}
+	return n, cas, err
+}
+
+// Append appends to a value on both clusters. See Client.Append.
+func (d *DualClient) Append(key, val string, ocas uint64) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.Append(key, val, ocas); err == nil {
+		s.Append(key, val, 0)
+	}
+	return cas, err
+}
+
+// Prepend prepends to a value on both clusters. See Client.Prepend.
+func (d *DualClient) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.Prepend(key, val, ocas); err == nil {
+		s.Prepend(key, val, 0)
+	}
+	return cas, err
+}
+
+// Del deletes a key on both clusters. See Client.Del.
+func (d *DualClient) Del(key string) (err error) {
+	return d.DelCAS(key, 0)
+}
+
+// DelCAS deletes a key on the primary if its CAS matches, and on the
+// secondary. See Client.DelCAS.
+func (d *DualClient) DelCAS(key string, cas uint64) (err error) {
+	p, s := d.clients()
+	if err = p.DelCAS(key, cas); err == nil {
+		s.Del(key)
+	}
+	return err
+}
+
+// Flush flushes both clusters. See Client.Flush.
+func (d *DualClient) Flush(when uint32) (err error) {
+	p, s := d.clients()
+	err = p.Flush(when)
+	s.Flush(when)
+	return err
+}
+
+// NoOp sends a No-Op message to both clusters. See Client.NoOp.
+func (d *DualClient) NoOp() (err error) {
+	p, s := d.clients()
+	err = p.NoOp()
+	s.NoOp()
+	return err
+}
+
+// Quit closes the connections to both clusters. See Client.Quit.
+func (d *DualClient) Quit() {
+	p, s := d.clients()
+	p.Quit()
+	s.Quit()
+}
+
+// GetTo retrieves a value from the primary and writes it to w. See
+// Client.GetTo.
+func (d *DualClient) GetTo(key string, w io.Writer) (flags uint32, cas uint64, err error) {
+	p, _ := d.clients()
+	return p.GetTo(key, w)
+}
+
+// SetFrom sets a key/value pair streamed from r on the primary, and streams it
+// from the primary to the secondary. See Client.SetFrom.
+func (d *DualClient) SetFrom(key string, r io.Reader, size int64, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	p, s := d.clients()
+	if cas, err = p.SetFrom(key, r, size, flags, exp, ocas); err == nil {
+		copyStream(p, s, key, size, flags, exp)
+	}
+	return cas, err
+}
+
+// copyStream copies the streamed value of key from p to s, deleting it from s
+// if the copy fails (e.g. if the value changed meanwhile).
+func copyStream(p, s *Client, key string, size int64, flags, exp uint32) {
+	pr, pw := io.Pipe()
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := p.GetTo(key, pw)
+		pw.CloseWithError(err)
+		read <- err
+	}()
+	_, err := s.SetFrom(key, pr, size, flags, exp, 0)
+	// unblock the reader if the value wasn't entirely consumed
+	pr.Close()
+	if rerr := <-read; err != nil || rerr != nil {
+		s.Del(key)
+	}
+}
+
+// GetOrLoad retrieves the value of key from the primary, loading it on a miss.
+// Loaded values are set on the secondary as well. See Client.GetOrLoad.
+func (d *DualClient) GetOrLoad(key string, ttl uint32, loader func() (string, error)) (string, error) {
+	p, s := d.clients()
+	return p.GetOrLoad(key, ttl, func() (string, error) {
+		val, err := loader()
+		if err == nil {
+			s.Set(key, val, 0, ttl, 0)
+		}
+		return val, err
+	})
+}
+
+// XFetch retrieves the value of key from the primary, computing it on a miss
+// or early. Computed values are set on the secondary as well. See
+// Client.XFetch.
+func (d *DualClient) XFetch(key string, ttl uint32, compute func() (string, error)) (string, error) {
+	p, s := d.clients()
+	return p.XFetch(key, ttl, func() (string, error) {
+		start := time.Now()
+		val, err := compute()
+		if err == nil {
+			s.setFetched(key, val, time.Since(start), ttl)
+		}
+		return val, err
+	})
+}
+
+// Update atomically replaces the value of key on the primary with the result
+// of fn, and copies it to the secondary. See Client.Update.
+func (d *DualClient) Update(key string, ttl uint32, fn func(old string, found bool) (string, error)) (val string, cas uint64, err error) {
+	p, s := d.clients()
+	val, flags, cas, err := p.update(key, ttl, fn)
+	if err == nil {
+		s.Set(key, val, flags, ttl, 0)
+	}
+	return val, cas, err
+}
+
+// Lock takes the lock key on the primary, and copies it to the secondary. The
+// copy is refreshed and released along with the lock. See Client.Lock.
+func (d *DualClient) Lock(key string, ttl uint32) (*Lock, error) {
+	p, s := d.clients()
+	l, err := p.Lock(key, ttl)
+	if err == nil {
+		l.mirror = s
+		s.Set(key, l.token, 0, ttl, 0)
+	}
+	return l, err
+}
+
+// LockWait is Lock but waits for the lock to be released. See
+// Client.LockWait.
+func (d *DualClient) LockWait(ctx context.Context, key string, ttl uint32) (*Lock, error) {
+	return lockWait(ctx, func() (*Lock, error) {
+		return d.Lock(key, ttl)
+	})
+}
+
+// Namespace returns a view of the client that scopes all keys to the namespace
+// name. See Client.Namespace.
+func (d *DualClient) Namespace(name string) *Namespace {
+	return &Namespace{client: d, name: name}
+}
+
+// generation returns the generation of a namespace on the primary, copied to
+// the secondary if it differs there.
+func (d *DualClient) generation(key string, delta uint64) (uint64, error) {
+	p, s := d.clients()
+	gen, err := p.generation(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	if sgen, err := s.generation(key, 0); err != nil || sgen != gen {
+		s.setCounter(key, gen)
+	}
+	return gen, nil
+}
+
+// Version gets the versions of the servers of both clusters. Only the errors
+// of the primary are returned. See Client.Version.
+func (d *DualClient) Version() (vers map[string]string, err error) {
+	p, s := d.clients()
+	vers, err = p.Version()
+	svers, _ := s.Version()
+	for addr, v := range svers {
+		vers[addr] = v
+	}
+	return vers, err
+}
+
+// StatsWithKey returns statistics about the servers of both clusters. Only the
+// errors of the primary are returned. See Client.StatsWithKey.
+func (d *DualClient) StatsWithKey(key string) (map[string]McStats, error) {
+	p, s := d.clients()
+	stats, err := p.StatsWithKey(key)
+	if err != nil {
+		return nil, err
+	}
+	sstats, _ := s.StatsWithKey(key)
+	for addr, st := range sstats {
+		stats[addr] = st
+	}
+	return stats, nil
+}
+
+// Stats returns statistics about the servers of both clusters. See
+// Client.Stats.
+func (d *DualClient) Stats() (stats map[string]McStats, err error) {
+	return d.StatsWithKey("")
+}
+
+// StatsReset resets the statistics of the servers of both clusters. See
+// Client.StatsReset.
+func (d *DualClient) StatsReset() (err error) {
+	_, err = d.StatsWithKey("reset")
+	return err
+}
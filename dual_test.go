@@ -0,0 +1,134 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDualClient(t *testing.T) {
+	fc := newFakeCluster()
+	d := NewDualClient(fc.client("old", DefaultConfig()), fc.client("new", DefaultConfig()))
+
+	_, err := d.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	for _, addr := range []string{"old", "new"} {
+		it, ok := fc.server(addr).get("foo")
+		assertTruef(t, ok && it.val == "bar", "%s should have the value", addr)
+	}
+
+	// CAS writes are copied once they succeed on the primary
+	_, _, cas, _ := d.Get("foo")
+	_, err = d.Set("foo", "baz", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ := fc.server("new").get("foo")
+	assertEqualf(t, "baz", it.val, "CAS write should be copied: %v", it.val)
+	_, err = d.Set("foo", "qux", 0, 0, cas)
+	assertEqualf(t, ErrKeyExists, err, "CAS mismatch should fail: %v", err)
+	it, _ = fc.server("new").get("foo")
+	assertEqualf(t, "baz", it.val, "failed CAS write shouldn't be copied: %v", it.val)
+
+	// GAT touches the secondary without shadow reads
+	_, _, _, err = d.GAT("foo", 100)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ = fc.server("new").get("foo")
+	assertTruef(t, !it.expires.IsZero(), "GAT should touch the secondary")
+
+	_, _, err = d.Incr("n", 1, 5, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	err = d.Del("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	for _, addr := range []string{"old", "new"} {
+		_, ok := fc.server(addr).get("foo")
+		assertTruef(t, !ok, "%s should be deleted", addr)
+		_, ok = fc.server(addr).get("n")
+		assertTruef(t, ok, "%s should have the counter", addr)
+	}
+
+	// reads are served by the primary, which can be swapped
+	fc.server("new").set("only", "new", 0)
+	_, _, _, err = d.Get("only")
+	assertEqualf(t, ErrNotFound, err, "primary should serve reads: %v", err)
+	d.Swap()
+	v, _, _, err := d.Get("only")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "new", v, "swapped primary should serve reads: %v", v)
+}
+
+func TestDualClientShadow(t *testing.T) {
+	fc := newFakeCluster()
+	d := NewDualClient(fc.client("old", DefaultConfig()), fc.client("new", DefaultConfig()))
+	mismatches := make(chan ShadowMismatch, 10)
+	d.SetShadowReads(1, func(m ShadowMismatch) { mismatches <- m })
+
+	d.Set("foo", "bar", 0, 0, 0)
+	d.Get("foo")
+	fc.server("old").set("stale", "old", 0)
+	d.Get("stale")
+
+	select {
+	case m := <-mismatches:
+		assertEqualf(t, "stale", m.Key, "wrong key: %v", m.Key)
+		assertEqualf(t, "old", m.Primary, "wrong primary value: %v", m.Primary)
+		assertEqualf(t, ErrNotFound, m.SecondaryErr, "wrong secondary error: %v", m.SecondaryErr)
+	case <-time.After(time.Second):
+		t.Fatal("mismatch should be reported")
+	}
+	time.Sleep(10 * time.Millisecond)
+	assertEqualf(t, uint64(1), d.ShadowMismatches(), "only one read should mismatch")
+}
+
+func TestDualClientComposite(t *testing.T) {
+	fc := newFakeCluster()
+	d := NewDualClient(fc.client("old", DefaultConfig()), fc.client("new", DefaultConfig()))
+	secondary := fc.server("new")
+
+	_, err := d.SetFrom("stream", strings.NewReader("streamed"), 8, 3, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, ok := secondary.get("stream")
+	assertTruef(t, ok && it.val == "streamed" && it.flags == 3, "streamed value should be copied: %v", it)
+
+	val, err := d.GetOrLoad("loaded", 0, func() (string, error) { return "v1", nil })
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, ok = secondary.get("loaded")
+	assertTruef(t, ok && it.val == val, "loaded value should be copied: %v", it)
+
+	_, err = d.XFetch("fetched", 100, func() (string, error) { return "v2", nil })
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, ok = secondary.get("fetched")
+	assertTruef(t, ok && it.flags&flagFetchMeta != 0, "computed value should be copied with its metadata: %v", it)
+
+	d.Set("updated", "1", 5, 0, 0)
+	_, _, err = d.Update("updated", 0, func(old string, found bool) (string, error) { return old + "2", nil })
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, ok = secondary.get("updated")
+	assertTruef(t, ok && it.val == "12" && it.flags == 5, "updated value should be copied with its flags: %v", it)
+
+	l, err := d.Lock("lock", 10)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, ok = secondary.get("lock")
+	assertTruef(t, ok, "lock should be copied")
+	assertEqualf(t, mcNil, l.Unlock(), "unexpected unlock error")
+	_, ok = secondary.get("lock")
+	assertTruef(t, !ok, "copy of the lock should be released")
+
+	// keys of namespaces stay reachable once swapped
+	ns := d.Namespace("ns")
+	_, err = ns.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	d.Swap()
+	v, _, _, err := ns.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+
+	stats, err := d.Stats()
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 2, len(stats), "stats of both clusters expected: %v", stats)
+
+	// writes failing on the primary aren't sent to the secondary
+	fc.server("new").setDown(true)
+	_, _, err = d.Incr("n", 1, 0, 0, 0)
+	assertNotEqualf(t, mcNil, err, "expected error")
+	_, ok = fc.server("old").get("n")
+	assertTruef(t, !ok, "failed write shouldn't be copied")
+}
@@ -0,0 +1,163 @@
+package mc
+
+// Encryption of values.
+//
+// When Config.Encryption is set, values are encrypted with AES-GCM (after
+// compression, which is useless on encrypted data) using the primary key of
+// the KeyRing, and marked as such in their flags. The envelope records the ID
+// of the key used, so values encrypted with a previous primary key can still
+// be decrypted as long as the key is in the ring, which allows key rotation.
+// The cache key is bound to the value as associated data, so a value copied
+// under another key fails to decrypt.
+//
+// The marker isn't covered by the envelope, so a client with Encryption set
+// refuses unmarked values with ErrDecrypt: a value stored in clear, or whose
+// marker was cleared, is never served as plaintext. So encryption is enabled on
+// an empty (or flushed) cluster, streams (GetTo, SetFrom) are refused, and the
+// counters of Incr and Decr, which can't be encrypted, are only read by them.
+//
+// Envelope: version (1 byte), key ID (4 bytes), nonce, ciphertext and tag.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const envelopeVersion = 1
+
+// KeyRing holds the keys used to encrypt and decrypt values, identified by an
+// ID stored with each encrypted value. Values are encrypted with the primary
+// key. It is safe for concurrent use.
+type KeyRing struct {
+	lock    sync.RWMutex
+	primary uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+// NewKeyRing creates an empty key ring.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// AddKey adds an AES key (16, 24 or 32 bytes long) to the ring. The first key
+// added becomes the primary key.
+func (kr *KeyRing) AddKey(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	if _, ok := kr.keys[id]; ok {
+		return fmt.Errorf("mc: key %d already in key ring", id)
+	}
+	if len(kr.keys) == 0 {
+		kr.primary = id
+	}
+	kr.keys[id] = aead
+	return nil
+}
+
+// SetPrimary makes the key id the one used to encrypt values.
+func (kr *KeyRing) SetPrimary(id uint32) error {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		return fmt.Errorf("mc: key %d not in key ring", id)
+	}
+	kr.primary = id
+	return nil
+}
+
+// RemoveKey removes the key id from the ring, values encrypted with it can't be
+// decrypted anymore. The primary key can't be removed.
+func (kr *KeyRing) RemoveKey(id uint32) error {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	if id == kr.primary {
+		return fmt.Errorf("mc: can't remove primary key %d", id)
+	}
+	delete(kr.keys, id)
+	return nil
+}
+
+// seal encrypts val with the primary key, binding it to key.
+func (kr *KeyRing) seal(key, val string) (string, error) {
+	kr.lock.RLock()
+	id := kr.primary
+	aead, ok := kr.keys[id]
+	kr.lock.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("mc: key ring is empty")
+	}
+
+	env := make([]byte, 5+aead.NonceSize(), 5+aead.NonceSize()+len(val)+aead.Overhead())
+	env[0] = envelopeVersion
+	binary.BigEndian.PutUint32(env[1:], id)
+	nonce := env[5:]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return string(aead.Seal(env, nonce, []byte(val), []byte(key))), nil
+}
+
+// open decrypts an envelope created by seal for key.
+func (kr *KeyRing) open(key, env string) (string, bool) {
+	if len(env) < 5 || env[0] != envelopeVersion {
+		return "", false
+	}
+	b := []byte(env)
+	kr.lock.RLock()
+	aead, ok := kr.keys[binary.BigEndian.Uint32(b[1:])]
+	kr.lock.RUnlock()
+	if !ok || len(b) < 5+aead.NonceSize() {
+		return "", false
+	}
+
+	nonce := b[5 : 5+aead.NonceSize()]
+	val, err := aead.Open(nil, nonce, b[5+aead.NonceSize():], []byte(key))
+	if err != nil {
+		return "", false
+	}
+	return string(val), true
+}
+
+// encrypt encrypts val stored under key as configured and returns the flags to
+// store along with it.
+func (c *Client) encrypt(key, val string, flags uint32) (string, uint32, error) {
+	if c.config.Encryption == nil {
+		return val, flags, nil
+	}
+	val, err := c.config.Encryption.seal(key, val)
+	if err != nil {
+		return "", flags, wrapError(StatusUnknownError, err)
+	}
+	return val, flags | flagEncrypted, nil
+}
+
+// decrypt decrypts val read from key according to flags.
+func (c *Client) decrypt(key, val string, flags uint32) (string, error) {
+	if flags&flagEncrypted == 0 {
+		if c.config.Encryption != nil {
+			return "", ErrDecrypt
+		}
+		return val, nil
+	}
+	if c.config.Encryption == nil {
+		return "", ErrDecrypt
+	}
+	val, ok := c.config.Encryption.open(key, val)
+	if !ok {
+		return "", ErrDecrypt
+	}
+	return val, nil
+}
@@ -0,0 +1,120 @@
+package mc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testKeyRing(t *testing.T, ids ...uint32) *KeyRing {
+	kr := NewKeyRing()
+	for _, id := range ids {
+		err := kr.AddKey(id, bytes.Repeat([]byte{byte(id)}, 32))
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+	}
+	return kr
+}
+
+func TestKeyRing(t *testing.T) {
+	kr := NewKeyRing()
+	_, err := kr.seal("foo", "bar")
+	assertNotEqualf(t, nil, err, "empty key ring shouldn't encrypt")
+	assertNotEqualf(t, nil, kr.AddKey(1, []byte("short")), "invalid key length should fail")
+
+	kr = testKeyRing(t, 1, 2)
+	assertNotEqualf(t, nil, kr.AddKey(1, bytes.Repeat([]byte{1}, 16)), "duplicate key ID should fail")
+	assertNotEqualf(t, nil, kr.SetPrimary(3), "unknown primary key should fail")
+	assertNotEqualf(t, nil, kr.RemoveKey(1), "primary key can't be removed")
+
+	env, err := kr.seal("foo", "bar")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	val, ok := kr.open("foo", env)
+	assertTruef(t, ok && val == "bar", "round trip failed")
+	_, ok = kr.open("other", env)
+	assertTruef(t, !ok, "value bound to another key shouldn't decrypt")
+	_, ok = kr.open("foo", env[:len(env)-1]+"x")
+	assertTruef(t, !ok, "tampered value shouldn't decrypt")
+	_, ok = kr.open("foo", env[:3])
+	assertTruef(t, !ok, "truncated value shouldn't decrypt")
+}
+
+func TestEncryption(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Encryption = testKeyRing(t, 1)
+	config.Compression.Compressor = LZCompressor
+	config.Compression.Threshold = 100
+	c := fc.client("a", config)
+
+	const FLAGS uint32 = 42
+	big := strings.Repeat("Lorem ipsum dolor sit amet. ", 100)
+	_, err := c.Set("foo", big, FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	it, _ := fc.server("a").get("foo")
+	assertTruef(t, it.flags&flagEncrypted != 0, "value should be marked encrypted")
+	assertEqualf(t, LZCompressor.ID(), compressorID(it.flags), "value should be compressed before encryption")
+	assertTruef(t, !strings.Contains(it.val, "Lorem"), "value shouldn't be stored in clear")
+
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertTruef(t, v == big, "wrong value")
+	v, _, _, err = c.GAT("foo", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, v == big, "GAT should decrypt")
+
+	// a value copied under another key is rejected
+	srv := fc.server("a")
+	srv.lock.Lock()
+	srv.store("bar", it.val, it.flags, 0)
+	srv.lock.Unlock()
+	_, _, _, err = c.Get("bar")
+	assertEqualf(t, ErrDecrypt, err, "copied value should fail to decrypt: %v", err)
+
+	// readers without the key ring can't read encrypted values
+	_, _, _, err = fc.client("a", DefaultConfig()).Get("foo")
+	assertEqualf(t, ErrDecrypt, err, "reader without keys should fail: %v", err)
+
+	// plain values aren't served, nor values whose marker was cleared
+	_, err = fc.client("a", DefaultConfig()).Set("plain", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("plain")
+	assertEqualf(t, ErrDecrypt, err, "plain value should be refused: %v", err)
+	srv.lock.Lock()
+	srv.store("foo", it.val, it.flags&^flagEncrypted, 0)
+	srv.lock.Unlock()
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrDecrypt, err, "unmarked ciphertext should be refused: %v", err)
+	_, err = c.SetFrom("plain", strings.NewReader("bar"), 3, 0, 0, 0)
+	assertEqualf(t, ErrNotStreamable, err, "streams should be refused: %v", err)
+}
+
+func TestEncryptionRotation(t *testing.T) {
+	fc := newFakeCluster()
+	kr := testKeyRing(t, 1)
+	config := DefaultConfig()
+	config.Encryption = kr
+	config.ChunkSize = 64
+	c := fc.client("a", config)
+
+	big := strings.Repeat("x", 1000)
+	_, err := c.Set("old", big, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	assertEqualf(t, nil, kr.AddKey(2, bytes.Repeat([]byte{2}, 32)), "unexpected error")
+	assertEqualf(t, nil, kr.SetPrimary(2), "unexpected error")
+	_, err = c.Set("new", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, _, _, err := c.Get("old")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, v == big, "value encrypted with previous key should decrypt")
+	v, _, _, err = c.Get("new")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+
+	assertEqualf(t, nil, kr.RemoveKey(1), "unexpected error")
+	_, _, _, err = c.Get("old")
+	assertEqualf(t, ErrDecrypt, err, "value encrypted with removed key shouldn't decrypt: %v", err)
+}
@@ -0,0 +1,355 @@
+package mc
+
+// An in-memory memcached used to test the client without a running server.
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeItem struct {
+	val     string
+	flags   uint32
+	cas     uint64
+	expires time.Time
+}
+
+// fakeServer stores items like a memcached server would.
+type fakeServer struct {
+	lock  sync.Mutex
+	items map[string]*fakeItem
+	cas   uint64
+	down  bool
+	delay time.Duration
+	ops   int
+}
+
+// fakeCluster is a set of fakeServers, identified by their address.
+type fakeCluster struct {
+	lock    sync.Mutex
+	servers map[string]*fakeServer
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{servers: make(map[string]*fakeServer)}
+}
+
+// server returns the server with the given address, the default port is added
+// if missing.
+func (fc *fakeCluster) server(address string) *fakeServer {
+	if !strings.Contains(address, ":") {
+		address += ":" + defaultPort
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	s, ok := fc.servers[address]
+	if !ok {
+		s = &fakeServer{items: make(map[string]*fakeItem)}
+		fc.servers[address] = s
+	}
+	return s
+}
+
+// newTestClient creates a cluster and a client connected to its server "a",
+// with config (the default configuration if nil).
+func newTestClient(config *Config) (*fakeCluster, *Client) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	fc := newFakeCluster()
+	return fc, fc.client("a", config)
+}
+
+// client creates a client connected to servers of the cluster.
+func (fc *fakeCluster) client(servers string, config *Config) *Client {
+	return newMockableMC(servers, "", "", config, fc.newConn)
+}
+
+func (fc *fakeCluster) newConn(address, scheme, username, password string, config *Config) mcConn {
+	return &fakeConn{srv: fc.server(address)}
+}
+
+func (s *fakeServer) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+// setDelay makes the server answer requests after delay.
+func (s *fakeServer) setDelay(delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delay = delay
+}
+
+func (s *fakeServer) get(key string) (*fakeItem, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	it := s.lookup(key)
+	if it == nil {
+		return nil, false
+	}
+	cp := *it
+	return &cp, true
+}
+
+// set stores a value as is, bypassing the client.
+func (s *fakeServer) set(key, val string, flags uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.store(key, val, flags, 0)
+}
+
+func (s *fakeServer) delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.items, key)
+}
+
+func (s *fakeServer) keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var keys []string
+	for k := range s.items {
+		if s.lookup(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (s *fakeServer) lookup(key string) *fakeItem {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.expires.IsZero() && !time.Now().Before(it.expires) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+func fakeExpiry(exp uint32) time.Time {
+	switch {
+	case exp == 0:
+		return time.Time{}
+	case exp <= 60*60*24*30:
+		return time.Now().Add(time.Duration(exp) * time.Second)
+	}
+	return time.Unix(int64(exp), 0)
+}
+
+func (s *fakeServer) store(key, val string, flags, exp uint32) *fakeItem {
+	s.cas++
+	it := &fakeItem{val: val, flags: flags, cas: s.cas, expires: fakeExpiry(exp)}
+	s.items[key] = it
+	return it
+}
+
+func respond(m *msg, it *fakeItem) {
+	m.val = it.val
+	m.CAS = it.cas
+	for _, e := range m.oextras {
+		if flags, ok := e.(*uint32); ok {
+			*flags = it.flags
+		}
+	}
+}
+
+// handle executes the request m and stores the response in m.
+func (s *fakeServer) handle(m *msg) uint16 {
+	s.ops++
+	it := s.lookup(m.key)
+	ocas, val := m.CAS, m.val
+	m.val, m.CAS = "", 0
+	if ocas != 0 && it != nil && it.cas != ocas {
+		switch m.Op {
+		case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ, opTouch:
+		default:
+			return StatusKeyExists
+		}
+	}
+
+	switch m.Op {
+	case opGet, opGetQ, opGetK, opGetKQ:
+		if it == nil {
+			return StatusNotFound
+		}
+		respond(m, it)
+
+	case opGAT, opGATQ, opGATK, opGATKQ, opTouch:
+		if it == nil {
+			return StatusNotFound
+		}
+		it.expires = fakeExpiry(m.iextras[0].(uint32))
+		if m.Op == opTouch {
+			m.CAS = it.cas
+		} else {
+			respond(m, it)
+		}
+
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		if m.valReader != nil {
+			b := make([]byte, m.valLen)
+			if _, err := io.ReadFull(m.valReader, b); err != nil {
+				return StatusInvalidArgs
+			}
+			val = string(b)
+		}
+		switch {
+		case (m.Op == opAdd || m.Op == opAddQ) && it != nil:
+			return StatusKeyExists
+		case (m.Op == opReplace || m.Op == opReplaceQ || ocas != 0) && it == nil:
+			return StatusNotFound
+		}
+		m.CAS = s.store(m.key, val, m.iextras[0].(uint32), m.iextras[1].(uint32)).cas
+
+	case opDelete, opDeleteQ:
+		if it == nil {
+			return StatusNotFound
+		}
+		delete(s.items, m.key)
+
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		delta := m.iextras[0].(uint64)
+		exp := m.iextras[2].(uint32)
+		var n uint64
+		if it == nil {
+			if exp == 0xffffffff {
+				return StatusNotFound
+			}
+			n = m.iextras[1].(uint64)
+			it = s.store(m.key, "", 0, exp)
+		} else {
+			var err error
+			n, err = strconv.ParseUint(it.val, 10, 64)
+			if err != nil {
+				return StatusNonNumeric
+			}
+			switch {
+			case m.Op == opIncrement || m.Op == opIncrementQ:
+				n += delta
+			case delta > n:
+				n = 0
+			default:
+				n -= delta
+			}
+			s.cas++
+			it.cas = s.cas
+		}
+		it.val = strconv.FormatUint(n, 10)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		m.val = string(b[:])
+		m.CAS = it.cas
+
+	case opAppend, opAppendQ, opPrepend, opPrependQ:
+		if it == nil {
+			return StatusValueNotStored
+		}
+		if m.Op == opPrepend || m.Op == opPrependQ {
+			val = val + it.val
+		} else {
+			val = it.val + val
+		}
+		s.cas++
+		it.val, it.cas = val, s.cas
+		m.CAS = it.cas
+
+	case opFlush, opFlushQ:
+		s.items = make(map[string]*fakeItem)
+
+	case opNoop:
+
+	case opVersion:
+		m.val = "1.6.0"
+
+	default:
+		return StatusUnknownCommand
+	}
+	return StatusOK
+}
+
+// fakeConn is a connection to a fakeServer.
+type fakeConn struct {
+	srv *fakeServer
+}
+
+func (fc *fakeConn) perform(m *msg) error {
+	fc.srv.lock.Lock()
+	delay := fc.srv.delay
+	fc.srv.lock.Unlock()
+	time.Sleep(delay)
+
+	fc.srv.lock.Lock()
+	defer fc.srv.lock.Unlock()
+	if fc.srv.down {
+		return &Error{StatusNetworkError, "Fake server down", nil}
+	}
+	m.ResvOrStatus = fc.srv.handle(m)
+	reply(m)
+	if m.ResvOrStatus == StatusOK && m.valWriter != nil {
+		if _, err := m.valWriter.Write([]byte(m.val)); err != nil {
+			return wrapError(StatusUnknownError, err)
+		}
+		m.val = ""
+	}
+	return newError(m.ResvOrStatus)
+}
+
+func (fc *fakeConn) performBatch(ms []*msg) error {
+	fc.srv.lock.Lock()
+	defer fc.srv.lock.Unlock()
+	if fc.srv.down {
+		return &Error{StatusNetworkError, "Fake server down", nil}
+	}
+	for _, m := range ms {
+		m.ResvOrStatus = fc.srv.handle(m)
+		if !quiet(m.Op) || (m.ResvOrStatus == StatusOK) == isGet(m.Op) {
+			reply(m)
+		}
+	}
+	return nil
+}
+
+// reply shapes the response in m like one read from the wire: only the K
+// variants of gets return the key, and errors come with a message as value.
+func reply(m *msg) {
+	switch m.Op {
+	case opGetK, opGetKQ, opGATK, opGATKQ:
+	default:
+		m.key = ""
+	}
+	if m.ResvOrStatus != StatusOK {
+		m.val = newError(m.ResvOrStatus).Error()
+	}
+}
+
+func quiet(op opCode) bool {
+	switch op {
+	case opGetQ, opGetKQ, opGATQ, opGATKQ, opSetQ, opAddQ, opReplaceQ, opDeleteQ,
+		opIncrementQ, opDecrementQ, opQuitQ, opFlushQ, opAppendQ, opPrependQ:
+		return true
+	}
+	return false
+}
+
+func isGet(op opCode) bool {
+	switch op {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ:
+		return true
+	}
+	return false
+}
+
+func (fc *fakeConn) performStats(m *msg) (McStats, error) {
+	return McStats{}, nil
+}
+
+func (fc *fakeConn) quit(m *msg) {
+}
@@ -0,0 +1,66 @@
+package mc
+
+// Layout of the flags stored along with each value.
+//
+// Flags are opaque to memcached, so the client uses them to record how a value
+// was stored (e.g. that it is split across several keys), which lets readers
+// decode values regardless of their own configuration. The upper 12 bits are
+// reserved for the client, user flags are limited to the lower 20 bits:
+//
+//	bit  31    : value is a chunk manifest (see Config.ChunkSize)
+//	bit  30    : value is encrypted (see Config.Encryption)
+//	bit  29    : value is in a checksum envelope (see Config.Checksum)
+//	bit  28    : value starts with XFetch metadata (see Client.XFetch)
+//	bits 24..27: ID of the Compressor the value was compressed with (0 if none)
+//	bits 20..23: ID of the Codec the value was encoded with (0 if none)
+//	bits  0..19: user flags
+//
+// With Config.RawFlags, no bit is reserved: flags are stored and returned as
+// given and never interpreted, which rules out the features above.
+
+const (
+	flagsReserved        = uint32(0xfff00000)
+	flagChunked          = uint32(1 << 31)
+	flagEncrypted        = uint32(1 << 30)
+	flagChecksum         = uint32(1 << 29)
+	flagFetchMeta        = uint32(1 << 28)
+	flagsCompressor      = uint32(0x0f000000)
+	flagsCompressorShift = 24
+	flagsCodec           = uint32(0x00f00000)
+	flagsCodecShift      = 20
+)
+
+// compressorFlags returns flags recording that a value was compressed with
+// compressor id.
+func compressorFlags(id uint8) uint32 {
+	return uint32(id) << flagsCompressorShift & flagsCompressor
+}
+
+// compressorID returns the ID of the compressor recorded in flags.
+func compressorID(flags uint32) uint8 {
+	return uint8((flags & flagsCompressor) >> flagsCompressorShift)
+}
+
+// codecFlags returns flags recording that a value was encoded with codec id.
+func codecFlags(id uint8) uint32 {
+	return uint32(id) << flagsCodecShift & flagsCodec
+}
+
+// codecID returns the ID of the codec recorded in flags.
+func codecID(flags uint32) uint8 {
+	return uint8((flags & flagsCodec) >> flagsCodecShift)
+}
+
+// reservedFlags returns the bits of the flags reserved by c: the upper 12 bits,
+// or none with Config.RawFlags.
+func (c *Client) reservedFlags() uint32 {
+	if c.config.RawFlags {
+		return 0
+	}
+	return flagsReserved
+}
+
+// userFlags strips the bits reserved by c from flags.
+func (c *Client) userFlags(flags uint32) uint32 {
+	return flags &^ c.reservedFlags()
+}
@@ -0,0 +1,66 @@
+package mc
+
+// Gutter pool.
+//
+// By default, the keys of a dead server are sent to the next alive server,
+// which then serves two shards and fills its memory with keys it will keep
+// serving from long after the dead server came back. With Config.GutterServers
+// set, the keys of dead servers are instead sent to a separate (small) pool of
+// gutter servers, and stored there with an expiration of at most
+// Config.GutterTTL, so the gutter pool only absorbs the load while servers are
+// down and doesn't hold stale values afterwards.
+//
+// Replicated keys fall back to their replicas instead.
+
+// gutterServer returns the alive gutter server for key.
+func (c *Client) gutterServer(key string) (*server, bool) {
+	idx, err := c.gutterHasher.getServerIndex(c.hashKey(key))
+	if err != nil {
+		return nil, false
+	}
+	nServers := uint(len(c.gutter))
+	for i := uint(0); i < nServers; i++ {
+		s := c.gutter[(idx+i)%nServers]
+		if s.isAlive {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// allServers returns the servers of the client, including the gutter pool.
+func (c *Client) allServers() []*server {
+	servers := make([]*server, 0, len(c.servers)+len(c.gutter))
+	servers = append(servers, c.servers...)
+	return append(servers, c.gutter...)
+}
+
+// clampExp limits the expiration set by m to the gutter TTL.
+func (s *server) clampExp(m *msg) {
+	var i int
+	switch m.Op {
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		i = 1
+	case opTouch, opGAT, opGATQ, opGATK, opGATKQ:
+		i = 0
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		i = 2
+	default:
+		return
+	}
+	if len(m.iextras) <= i {
+		return
+	}
+
+	exp := m.iextras[i].(uint32)
+	// absolute expirations are larger than any sensible TTL, and all ones
+	// means incr/decr shouldn't create the key
+	if exp != 0 && exp <= s.config.GutterTTL || exp == 0xffffffff {
+		return
+	}
+	// copy the extras, they may be shared with requests to other servers
+	iextras := make([]interface{}, len(m.iextras))
+	copy(iextras, m.iextras)
+	iextras[i] = s.config.GutterTTL
+	m.iextras = iextras
+}
@@ -0,0 +1,75 @@
+package mc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGutter(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.GutterServers = "g"
+	config.GutterTTL = 5
+	config.Retries = 1
+	c := fc.client("a b", config)
+
+	s, err := c.getServer("foo")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	primary := fc.server(s.address)
+	var other *fakeServer
+	for _, s := range c.servers {
+		if fc.server(s.address) != primary {
+			other = fc.server(s.address)
+		}
+	}
+
+	// keys of a dead server go to the gutter pool, with clamped expirations
+	primary.setDown(true)
+	_, err = c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, ok := other.get("foo")
+	assertTruef(t, !ok, "keys of dead server shouldn't go to the next server")
+	it, ok := fc.server("g").get("foo")
+	assertTruef(t, ok && it.val == "bar", "keys of dead server should go to the gutter pool")
+	assertTruef(t, !it.expires.IsZero() && it.expires.Before(time.Now().Add(6*time.Second)),
+		"expiration should be clamped: %v", it.expires)
+
+	_, err = c.Set("foo", "bar", 0, 2, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ = fc.server("g").get("foo")
+	assertTruef(t, it.expires.Before(time.Now().Add(3*time.Second)), "shorter expiration should be kept: %v", it.expires)
+
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "gutter pool should serve the key: %v", v)
+
+	_, _, err = c.Incr("counter", 1, 0, 0xffffffff, 0)
+	if s, _ := c.getServer("counter"); s.gutter {
+		assertEqualf(t, ErrNotFound, err, "incr shouldn't create the key: %v", err)
+	}
+
+	// back to the primary once it's alive
+	primary.setDown(false)
+	for _, s := range c.servers {
+		s.changeAlive(true)
+	}
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrNotFound, err, "primary should serve the key again: %v", err)
+}
+
+func TestGutterClampExp(t *testing.T) {
+	s := &server{config: DefaultConfig(), gutter: true}
+	extras := []interface{}{uint32(0), uint32(3600)}
+	m := &msg{header: header{Op: opSet}, iextras: extras}
+	s.clampExp(m)
+	assertEqualf(t, s.config.GutterTTL, m.iextras[1].(uint32), "expiration should be clamped")
+	assertEqualf(t, uint32(3600), extras[1].(uint32), "extras shouldn't be modified in place")
+
+	m = &msg{header: header{Op: opIncrement}, iextras: []interface{}{uint64(1), uint64(0), uint32(0xffffffff)}}
+	s.clampExp(m)
+	assertEqualf(t, uint32(0xffffffff), m.iextras[2].(uint32), "incr without creation should be kept")
+
+	m = &msg{header: header{Op: opFlush}, iextras: []interface{}{uint32(3600)}}
+	s.clampExp(m)
+	assertEqualf(t, uint32(3600), m.iextras[0].(uint32), "flush shouldn't be changed")
+}
@@ -2,39 +2,56 @@ package mc
 
 //
 
-import (
-	"hash"
-	"hash/fnv"
-	"io"
-)
-
 type hasher interface {
 	update(servers []*server)
 	getServerIndex(key string) (uint, error)
 }
 
 type moduloHasher struct {
-	nServers uint
-	h32      hash.Hash32
+	// slots holds the index of each server as many times as its weight
+	slots []uint
 }
 
 func NewModuloHasher() hasher {
-	var h hasher = &moduloHasher{h32: fnv.New32a()}
+	var h hasher = &moduloHasher{}
 	return h
 }
 
 func (h *moduloHasher) update(servers []*server) {
-	h.nServers = uint(len(servers))
+	var slots []uint
+	for i, s := range servers {
+		for w := 0; w < s.weight; w++ {
+			slots = append(slots, uint(i))
+		}
+	}
+	h.slots = slots
 }
 
 func (h *moduloHasher) getServerIndex(key string) (uint, error) {
-	if h.nServers < 1 {
+	if len(h.slots) < 1 {
 		return 0, &Error{StatusNetworkError, "No server available", nil}
 	}
 
-	// Use io.WriteString to avoid []byte(key) allocation
-	io.WriteString(h.h32, key)
-	defer h.h32.Reset()
+	return h.slots[uint(fnv1a32(key))%uint(len(h.slots))], nil
+}
 
-	return uint(h.h32.Sum32()) % h.nServers, nil
+// fnv1a32 returns the 32-bit FNV-1a hash of key, computed inline to avoid
+// allocations and sharing a hash.Hash32 between goroutines.
+func fnv1a32(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// fnv1a64 returns the 64-bit FNV-1a hash of key, see fnv1a32.
+func fnv1a64(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return hash
 }
@@ -0,0 +1,76 @@
+package mc
+
+import (
+	"hash/fnv"
+	"strconv"
+	"testing"
+)
+
+func TestParseServerOptions(t *testing.T) {
+	cases := []struct {
+		address, addr, weight string
+	}{
+		{"host:11211", "host:11211", ""},
+		{"host:11211?weight=4", "host:11211", "4"},
+		{"host:11211:4", "host:11211", "4"},
+		{"host:11211:4?zone=a", "host:11211", "4"},
+		{"host:11211:4?weight=2", "host:11211", "2"},
+		{"tcp://host:11211?weight=2", "tcp://host:11211", "2"},
+		{"[::1]:11211", "[::1]:11211", ""},
+		{"[::1]:11211:3", "[::1]:11211", "3"},
+		{"::1", "::1", ""},
+		{"fe80::1", "fe80::1", ""},
+		{"2001:db8::8:800:200c:417a", "2001:db8::8:800:200c:417a", ""},
+		{"host:port:4", "host:port:4", ""},
+		{"unix:///tmp/mc.sock", "unix:///tmp/mc.sock", ""},
+	}
+	for _, tc := range cases {
+		addr, options := parseServerOptions(tc.address)
+		assertEqualf(t, tc.addr, addr, "wrong address for %q: %v", tc.address, addr)
+		assertEqualf(t, tc.weight, options.Get("weight"), "wrong weight for %q", tc.address)
+	}
+
+	s := newServer("host:11211:4", "", "", DefaultConfig(), newMockConn)
+	assertEqualf(t, "host:11211", s.address, "wrong address: %v", s.address)
+	assertEqualf(t, 4, s.weight, "wrong weight: %v", s.weight)
+	s = newServer("fe80::1", "", "", DefaultConfig(), newMockConn)
+	assertEqualf(t, "[fe80::1]:11211", s.address, "wrong address: %v", s.address)
+	s = newServer("host?weight=x", "", "", DefaultConfig(), newMockConn)
+	assertEqualf(t, 1, s.weight, "invalid weight should default to 1: %v", s.weight)
+	s = newServer("host:11211:4?zone=a", "", "", DefaultConfig(), newMockConn)
+	assertEqualf(t, "host:11211", s.address, "wrong address: %v", s.address)
+	assertEqualf(t, 4, s.weight, "wrong weight: %v", s.weight)
+	assertEqualf(t, "a", s.zone, "wrong zone: %v", s.zone)
+	s = newServer("host?weight=1000000000", "", "", DefaultConfig(), newMockConn)
+	assertEqualf(t, maxWeight, s.weight, "weight should be clamped: %v", s.weight)
+}
+
+func TestModuloHasherWeights(t *testing.T) {
+	// without weights, keys are distributed as before
+	c := newFakeCluster().client("a b c", DefaultConfig())
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		idx, _ := c.config.Hasher.getServerIndex(key)
+		assertEqualf(t, uint(h.Sum32())%3, idx, "wrong server for %s", key)
+	}
+
+	c = newFakeCluster().client("a:11211:1 b:11211?weight=3", DefaultConfig())
+	counts := make([]int, 2)
+	for i := 0; i < 10000; i++ {
+		idx, _ := c.config.Hasher.getServerIndex("key" + strconv.Itoa(i))
+		counts[idx]++
+	}
+	assertTruef(t, counts[1] > 7000 && counts[1] < 8000, "heavier server should get 3/4 of the keys: %v", counts)
+}
+
+func TestFNV1a(t *testing.T) {
+	for _, key := range []string{"", "a", "foo", "key with spaces"} {
+		h32, h64 := fnv.New32a(), fnv.New64a()
+		h32.Write([]byte(key))
+		h64.Write([]byte(key))
+		assertEqualf(t, h32.Sum32(), fnv1a32(key), "wrong 32-bit hash of %q", key)
+		assertEqualf(t, h64.Sum64(), fnv1a64(key), "wrong 64-bit hash of %q", key)
+	}
+}
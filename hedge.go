@@ -0,0 +1,197 @@
+package mc
+
+// Hedged reads.
+//
+// With Config.HedgeDelay set, a Get the server hasn't answered within the delay
+// is sent again, to the next replica with replication (see Config.Replicas) or
+// over another connection to the same server otherwise (which needs a
+// Config.PoolSize above 1), and the first successful reply is returned. The
+// other request is abandoned: its reply is discarded once it arrives, and its
+// connection goes back to the pool. With Config.HedgePercentile set, the delay
+// follows that percentile of the latencies of recent reads instead (but is at
+// least HedgeDelay), e.g. 0.95 to hedge the slowest 5% of the reads.
+//
+// Hedges add load to the servers when they are slow, so their number is
+// capped to a fraction of the reads (Config.HedgeBudget): each read earns that
+// fraction of a hedge, and a hedge is only sent if a whole one was earned.
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hedgeSamples is the number of recent latencies the delay is computed
+	// from, and hedgeRecompute how often it is.
+	hedgeSamples   = 512
+	hedgeRecompute = 32
+	// hedgeBurst is the number of hedges that can be earned in advance.
+	hedgeBurst = 10
+)
+
+// hedger decides when to hedge reads. A nil hedger is disabled.
+type hedger struct {
+	minDelay   time.Duration
+	percentile float64
+	budget     float64
+
+	lock      sync.Mutex
+	delay     time.Duration
+	tokens    float64
+	latencies [hedgeSamples]time.Duration
+	observed  int
+}
+
+func newHedger(config *Config) *hedger {
+	return &hedger{
+		minDelay:   config.HedgeDelay,
+		percentile: config.HedgePercentile,
+		budget:     config.HedgeBudget,
+		delay:      config.HedgeDelay,
+	}
+}
+
+// currentDelay returns how long to wait for a reply before hedging.
+func (h *hedger) currentDelay() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.delay
+}
+
+// observe records the latency of a read.
+func (h *hedger) observe(latency time.Duration) {
+	if h.percentile <= 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.latencies[h.observed%hedgeSamples] = latency
+	h.observed++
+	if h.observed%hedgeRecompute != 0 {
+		return
+	}
+
+	n := h.observed
+	if n > hedgeSamples {
+		n = hedgeSamples
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, h.latencies[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	h.delay = sorted[int(h.percentile*float64(n-1))]
+	if h.delay < h.minDelay {
+		h.delay = h.minDelay
+	}
+}
+
+// earn adds the share of a hedge earned by a read to the budget.
+func (h *hedger) earn() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.tokens += h.budget
+	if h.tokens > hedgeBurst {
+		h.tokens = hedgeBurst
+	}
+}
+
+// spend takes a hedge from the budget, if one was earned.
+func (h *hedger) spend() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedgeReply is the reply to one of the requests of a hedged read.
+type hedgeReply struct {
+	m     *msg
+	flags uint32
+	err   error
+	hedge bool
+}
+
+// newHedgeReply copies the read m so it can be sent concurrently.
+func newHedgeReply(m *msg, hedge bool) *hedgeReply {
+	r := &hedgeReply{m: &msg{header: m.header, iextras: m.iextras, key: m.key}, hedge: hedge}
+	r.m.oextras = []interface{}{&r.flags}
+	return r
+}
+
+// apply stores the reply in m and returns its error.
+func (r *hedgeReply) apply(m *msg) error {
+	m.header, m.val = r.m.header, r.m.val
+	*m.oextras[0].(*uint32) = r.flags
+	return r.err
+}
+
+// performRead performs the plain read m (see plainRead), hedged if enabled.
+func (c *Client) performRead(m *msg) error {
+	if c.hedge == nil {
+		return c.performKey(m)
+	}
+	c.hedge.earn()
+
+	// m is only written once the requests are copied, as the abandoned one
+	// may still be running
+	primary, hedge := newHedgeReply(m, false), newHedgeReply(m, true)
+	replies := make(chan *hedgeReply, 2)
+	start := time.Now()
+	go func() {
+		primary.err = c.performKey(primary.m)
+		c.hedge.observe(time.Since(start))
+		replies <- primary
+	}()
+
+	timer := time.NewTimer(c.hedge.currentDelay())
+	defer timer.Stop()
+	select {
+	case r := <-replies:
+		return r.apply(m)
+	case <-timer.C:
+	}
+
+	s, err := c.hedgeServer(m.key)
+	if err != nil || !c.hedge.spend() {
+		return (<-replies).apply(m)
+	}
+	atomic.AddUint64(&c.metrics.hedges, 1)
+	go func() {
+		hedge.err = s.perform(hedge.m)
+		c.markDown(s, hedge.err)
+		replies <- hedge
+	}()
+
+	r := <-replies
+	if r.err != nil {
+		// wait for the other reply, which may succeed, and prefer the error of
+		// the primary request otherwise
+		if other := <-replies; other.err == nil || !other.hedge {
+			r = other
+		}
+	}
+	if r.hedge && r.err == nil {
+		atomic.AddUint64(&c.metrics.hedgeWins, 1)
+	}
+	return r.apply(m)
+}
+
+// hedgeServer returns the server a hedged read of key is sent to: the second
+// replica with replication, or the primary otherwise.
+func (c *Client) hedgeServer(key string) (*server, error) {
+	if c.config.Replicas > 1 {
+		servers, err := c.getServers(key, c.config.Replicas)
+		if err != nil {
+			return nil, err
+		}
+		if servers = c.preferLocal(servers); len(servers) > 1 {
+			return servers[1], nil
+		}
+		return servers[0], nil
+	}
+	return c.getServer(key)
+}
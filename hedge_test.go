@@ -0,0 +1,99 @@
+package mc
+
+import (
+	"testing"
+	"time"
+)
+
+func testHedgeConfig() *Config {
+	config := DefaultConfig()
+	config.HedgeDelay = 10 * time.Millisecond
+	config.HedgeBudget = 1
+	return config
+}
+
+func TestHedgedReads(t *testing.T) {
+	fc := newFakeCluster()
+	config := testHedgeConfig()
+	config.Replicas = 2
+	c := fc.client("a b", config)
+	replicas, _ := testReplicas(t, fc, c, "foo")
+
+	const FLAGS uint32 = 42
+	_, err := c.Set("foo", "bar", FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// fast replies aren't hedged
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, uint64(0), c.Metrics().Hedges, "fast read shouldn't be hedged")
+
+	// slow ones are sent to a replica as well
+	replicas[0].setDelay(time.Second)
+	defer replicas[0].setDelay(0)
+	start := time.Now()
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertTruef(t, time.Since(start) < 500*time.Millisecond, "hedge should answer first: %v", time.Since(start))
+	m := c.Metrics()
+	assertTruef(t, m.Hedges == 1 && m.HedgeWins == 1, "wrong metrics: %+v", m)
+
+	// a miss of the hedge waits for the primary
+	replicas[1].delete("foo")
+	v, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "primary should serve the value: %v", v)
+	assertEqualf(t, uint64(1), c.Metrics().HedgeWins, "failed hedge shouldn't win")
+}
+
+func TestHedgedReadsSameServer(t *testing.T) {
+	fc := newFakeCluster()
+	config := testHedgeConfig()
+	config.PoolSize = 2
+	c := fc.client("a", config)
+	c.Set("foo", "bar", 0, 0, 0)
+
+	// the hedge takes another connection, and is slow as well
+	fc.server("a").setDelay(50 * time.Millisecond)
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, uint64(1), c.Metrics().Hedges, "read should be hedged")
+}
+
+func TestHedgeBudget(t *testing.T) {
+	fc := newFakeCluster()
+	config := testHedgeConfig()
+	config.HedgeBudget = 0.5
+	config.PoolSize = 2
+	c := fc.client("a", config)
+	c.Set("foo", "bar", 0, 0, 0)
+
+	fc.server("a").setDelay(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		c.Get("foo")
+	}
+	assertEqualf(t, uint64(5), c.Metrics().Hedges, "hedges should be capped: %+v", c.Metrics())
+}
+
+func TestHedgePercentile(t *testing.T) {
+	config := testHedgeConfig()
+	config.HedgePercentile = 0.95
+	h := newHedger(config)
+	assertEqualf(t, 10*time.Millisecond, h.currentDelay(), "delay should start at HedgeDelay")
+
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	delay := h.currentDelay()
+	assertTruef(t, delay >= 90*time.Millisecond && delay <= 96*time.Millisecond, "delay should follow p95: %v", delay)
+
+	// the delay never goes below HedgeDelay
+	for i := 0; i < hedgeSamples; i++ {
+		h.observe(time.Millisecond)
+	}
+	assertEqualf(t, 10*time.Millisecond, h.currentDelay(), "delay should be at least HedgeDelay")
+}
@@ -0,0 +1,259 @@
+package mc
+
+// Hot keys.
+//
+// With Config.HotKeyThreshold set, the client samples the keys it reads
+// (Config.HotKeySampleRate of the reads) and counts them in a count-min sketch,
+// which takes a fixed amount of memory whatever the number of keys. Keys read
+// at least HotKeyThreshold times per Config.HotKeyWindow (as estimated from the
+// samples) are hot, and reported by Client.HotKeys. Counts are halved at the
+// end of each window, so keys cool down once their traffic drops.
+//
+// Hot keys can be served from a small local cache (Config.HotKeyCacheSize) for
+// up to Config.HotKeyCacheTTL, so a viral key doesn't saturate its server. The
+// client removes the keys it writes from the cache, but writes of other
+// clients are only seen once entries expire. With replication, reads of hot
+// keys can instead be spread across their replicas (Config.HotKeyFanout).
+//
+// Keys are counted as stored, i.e. after Config.KeyTransformer.
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dimensions of the count-min sketch. With these, the count of a key is
+// overestimated by at most 0.13% of the sampled reads with a probability
+// above 98%.
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+// HotKey is a key read at least Config.HotKeyThreshold times per
+// Config.HotKeyWindow.
+type HotKey struct {
+	Key string
+	// Reads is the estimated number of reads of the key in a window.
+	Reads uint64
+}
+
+// hotKeys detects the hot keys of a client. A nil hotKeys is disabled.
+type hotKeys struct {
+	lock      sync.RWMutex
+	threshold uint64
+	rate      float64
+	window    time.Duration
+	rotateAt  time.Time
+	counts    [sketchDepth][sketchWidth]uint32
+	hot       map[string]uint64
+	cache     *nearCache
+	now       func() time.Time
+}
+
+func newHotKeys(config *Config) *hotKeys {
+	h := &hotKeys{
+		threshold: config.HotKeyThreshold,
+		rate:      config.HotKeySampleRate,
+		window:    config.HotKeyWindow,
+		hot:       make(map[string]uint64),
+		now:       time.Now,
+	}
+	if config.HotKeyCacheSize > 0 {
+		h.cache = newNearCache(config.HotKeyCacheSize, config.HotKeyCacheTTL, nil)
+	}
+	h.rotateAt = h.now().Add(h.window)
+	return h
+}
+
+// record counts a read of key if it's sampled, and returns whether key is hot.
+// Reads that aren't sampled only take a read lock, and windows end on the next
+// sampled read.
+func (h *hotKeys) record(key string) bool {
+	if h == nil {
+		return false
+	}
+	if h.rate < 1 && rand.Float64() >= h.rate {
+		return h.isHot(key)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.rotate()
+	if reads := h.add(key); reads >= h.threshold {
+		h.hot[key] = reads
+	}
+	_, ok := h.hot[key]
+	return ok
+}
+
+// isHot returns whether key is hot.
+func (h *hotKeys) isHot(key string) bool {
+	if h == nil {
+		return false
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	_, ok := h.hot[key]
+	return ok
+}
+
+// slots returns the counter of key in each row of the sketch.
+func (h *hotKeys) slots(key string) [sketchDepth]uint32 {
+	// FNV-1a, split in two hashes combined as in double hashing
+	hash := fnv1a64(key)
+	h1, h2 := uint32(hash), uint32(hash>>32)|1
+	var slots [sketchDepth]uint32
+	for i := range slots {
+		slots[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return slots
+}
+
+// add counts a sampled read of key and returns its estimated number of reads.
+// Only the smallest counters are incremented (conservative update), which
+// reduces the overestimation of the other keys sharing them.
+func (h *hotKeys) add(key string) uint64 {
+	slots := h.slots(key)
+	min := h.min(slots) + 1
+	for i, j := range slots {
+		if h.counts[i][j] < min {
+			h.counts[i][j] = min
+		}
+	}
+	return h.estimate(min)
+}
+
+func (h *hotKeys) min(slots [sketchDepth]uint32) uint32 {
+	min := h.counts[0][slots[0]]
+	for i, j := range slots[1:] {
+		if n := h.counts[i+1][j]; n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// estimate scales a number of sampled reads to all reads.
+func (h *hotKeys) estimate(n uint32) uint64 {
+	if h.rate >= 1 {
+		return uint64(n)
+	}
+	return uint64(float64(n) / h.rate)
+}
+
+// rotate halves the counters at the end of each window (or clears them if
+// several windows went by) and drops the keys that aren't hot anymore.
+func (h *hotKeys) rotate() {
+	now := h.now()
+	if now.Before(h.rotateAt) {
+		return
+	}
+	reset := !now.Before(h.rotateAt.Add(h.window))
+	for i := range h.counts {
+		for j := range h.counts[i] {
+			if reset {
+				h.counts[i][j] = 0
+			} else {
+				h.counts[i][j] /= 2
+			}
+		}
+	}
+	for key := range h.hot {
+		if reads := h.estimate(h.min(h.slots(key))); reads >= h.threshold {
+			h.hot[key] = reads
+		} else {
+			delete(h.hot, key)
+		}
+	}
+	h.rotateAt = now.Add(h.window)
+}
+
+// list returns the hot keys, the most read first.
+func (h *hotKeys) list() []HotKey {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	h.rotate()
+	keys := make([]HotKey, 0, len(h.hot))
+	for key, reads := range h.hot {
+		keys = append(keys, HotKey{key, reads})
+	}
+	h.lock.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Reads > keys[j].Reads
+	})
+	return keys
+}
+
+// get serves the read m of a hot key from the local cache.
+func (h *hotKeys) get(m *msg, metrics *clientMetrics) bool {
+	if h == nil {
+		return false
+	}
+	val, flags, cas, ok := h.cache.get(m.key)
+	if !ok {
+		return false
+	}
+	atomic.AddUint64(&metrics.hotKeyHits, 1)
+	m.val, m.CAS = val, cas
+	*m.oextras[0].(*uint32) = flags
+	return true
+}
+
+// generation returns the invalidation counter of key in the local cache (see
+// nearCache.generation).
+func (h *hotKeys) generation(key string) uint64 {
+	if h == nil {
+		return 0
+	}
+	return h.cache.generation(key)
+}
+
+// put stores the result m of the read of the hot key in the local cache,
+// unless key was invalidated since generation returned gen.
+func (h *hotKeys) put(key string, m *msg, gen uint64) {
+	if h == nil {
+		return
+	}
+	h.cache.put(key, m.val, *m.oextras[0].(*uint32), m.CAS, 0, gen)
+}
+
+// invalidate removes key from the local cache.
+func (h *hotKeys) invalidate(key string) {
+	if h == nil {
+		return
+	}
+	h.cache.invalidate(key)
+}
+
+// clear empties the local cache.
+func (h *hotKeys) clear() {
+	if h == nil {
+		return
+	}
+	h.cache.clear()
+}
+
+// HotKeys returns the keys currently read at least Config.HotKeyThreshold
+// times per Config.HotKeyWindow, the most read first. It returns nil if hot key
+// detection is disabled.
+func (c *Client) HotKeys() []HotKey {
+	return c.hot.list()
+}
+
+// plainRead returns whether m is a plain Get, which can be counted for hot key
+// detection, served from the local cache and hedged.
+func plainRead(m *msg) bool {
+	return m.Op == opGet && !m.streaming() && len(m.oextras) == 1
+}
+
+// spread starts the list of replicas of a hot key at a random one, so its
+// reads are spread across them.
+func spread(servers []*server) []*server {
+	i := rand.Intn(len(servers))
+	return append(servers[i:len(servers):len(servers)], servers[:i]...)
+}
@@ -0,0 +1,149 @@
+package mc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testHotKeyConfig() *Config {
+	config := DefaultConfig()
+	config.HotKeyThreshold = 10
+	config.HotKeySampleRate = 1
+	config.HotKeyWindow = time.Minute
+	return config
+}
+
+func TestHotKeys(t *testing.T) {
+	fc := newFakeCluster()
+	c := fc.client("a", testHotKeyConfig())
+	now := time.Now()
+	c.hot.now = func() time.Time { return now }
+	c.Set("foo", "bar", 0, 0, 0)
+
+	for i := 0; i < 9; i++ {
+		c.Get("foo")
+	}
+	for i := 0; i < 100; i++ {
+		c.Get(fmt.Sprintf("key%d", i))
+	}
+	assertEqualf(t, 0, len(c.HotKeys()), "no key should be hot yet: %v", c.HotKeys())
+
+	c.Get("foo")
+	for i := 0; i < 20; i++ {
+		c.Get("bar")
+	}
+	hot := c.HotKeys()
+	assertEqualf(t, 2, len(hot), "wrong hot keys: %v", hot)
+	assertEqualf(t, HotKey{"bar", 20}, hot[0], "most read key should come first: %v", hot)
+	assertEqualf(t, HotKey{"foo", 10}, hot[1], "wrong hot key: %v", hot)
+
+	// writes aren't counted
+	for i := 0; i < 20; i++ {
+		c.Set("baz", "qux", 0, 0, 0)
+	}
+	assertEqualf(t, 2, len(c.HotKeys()), "writes shouldn't be counted: %v", c.HotKeys())
+
+	// counts are halved at the end of a window
+	now = now.Add(time.Minute)
+	hot = c.HotKeys()
+	assertEqualf(t, 1, len(hot), "cooled down keys should be dropped: %v", hot)
+	assertEqualf(t, HotKey{"bar", 10}, hot[0], "wrong hot key: %v", hot)
+	now = now.Add(3 * time.Minute)
+	assertEqualf(t, 0, len(c.HotKeys()), "idle keys should be dropped: %v", c.HotKeys())
+
+	assertTruef(t, fc.client("a", DefaultConfig()).HotKeys() == nil, "detection should be disabled by default")
+}
+
+func TestHotKeySampling(t *testing.T) {
+	config := testHotKeyConfig()
+	config.HotKeyThreshold = 1000
+	config.HotKeySampleRate = 0.1
+	c := newFakeCluster().client("a", config)
+
+	for i := 0; i < 2000; i++ {
+		c.Get("foo")
+	}
+	c.Get("bar")
+	hot := c.HotKeys()
+	assertEqualf(t, 1, len(hot), "wrong hot keys: %v", hot)
+	assertTruef(t, hot[0].Key == "foo" && hot[0].Reads > 1000 && hot[0].Reads < 3000,
+		"reads should be estimated from samples: %v", hot)
+}
+
+func TestHotKeyCache(t *testing.T) {
+	fc := newFakeCluster()
+	config := testHotKeyConfig()
+	config.HotKeyCacheSize = 1 << 20
+	config.HotKeyCacheTTL = time.Minute
+	c := fc.client("a", config)
+	srv := fc.server("a")
+
+	const FLAGS uint32 = 42
+	c.Set("foo", "bar", FLAGS, 0, 0)
+	for i := 0; i < 10; i++ {
+		c.Get("foo")
+	}
+
+	// hot keys are served locally
+	ops := srv.ops
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertEqualf(t, ops, srv.ops, "hot key should be served locally")
+	assertEqualf(t, uint64(1), c.Metrics().HotKeyHits, "wrong metrics: %+v", c.Metrics())
+
+	// writes of the client invalidate the cache
+	_, err = c.Append("foo", "!", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, _ = c.Get("foo")
+	assertEqualf(t, "bar!", v, "append should invalidate: %v", v)
+	c.Flush(0)
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrNotFound, err, "flush should clear: %v", err)
+
+	// other keys are read from the server
+	c.Set("baz", "qux", 0, 0, 0)
+	ops = srv.ops
+	c.Get("baz")
+	assertEqualf(t, ops+1, srv.ops, "cold key should be read from the server")
+}
+
+func TestHotKeyFanout(t *testing.T) {
+	fc := newFakeCluster()
+	config := testHotKeyConfig()
+	config.Replicas = 2
+	config.HotKeyFanout = true
+	c := fc.client("a b", config)
+	c.Set("foo", "bar", 0, 0, 0)
+
+	for i := 0; i < 100; i++ {
+		c.Get("foo")
+	}
+	a, b := fc.server("a").ops, fc.server("b").ops
+	for i := 0; i < 100; i++ {
+		c.Get("foo")
+	}
+	a, b = fc.server("a").ops-a, fc.server("b").ops-b
+	assertTruef(t, a > 10 && b > 10, "reads should be spread across replicas: %d, %d", a, b)
+}
+
+func TestHotKeyCacheServesFirstReads(t *testing.T) {
+	fc := newFakeCluster()
+	config := testHotKeyConfig()
+	config.HotKeyThreshold = 1
+	config.HotKeyCacheSize = 1 << 20
+	config.HotKeyCacheTTL = time.Minute
+	c := fc.client("a", config)
+	c.Set("foo", "bar", 0, 0, 0)
+
+	ops := fc.server("a").ops
+	for i := 0; i < 5; i++ {
+		v, _, _, err := c.Get("foo")
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, "bar", v, "wrong value: %v", v)
+	}
+	assertEqualf(t, ops+1, fc.server("a").ops, "only the first read should go to the server")
+	assertEqualf(t, uint64(4), c.Metrics().HotKeyHits, "wrong metrics: %+v", c.Metrics())
+}
@@ -0,0 +1,109 @@
+package mc
+
+// Client-side validation of keys.
+//
+// memcached limits keys to 250 bytes and the text protocol doesn't allow
+// whitespace or control characters in them. Keys are checked before being sent
+// so that an invalid key fails early with a clear error instead of a server
+// error after a round trip (or a silently truncated key length for huge keys).
+// Config.KeyTransformer allows mapping arbitrary keys to valid ones first, e.g.
+// with DigestKey.
+//
+// Keys derived by the client from the keys of users (e.g. the keys of chunks or
+// of the lock of GetOrLoad) embed a digest of the key instead of the key when
+// they would be too long.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MaxKeyLen is the maximum length of a key accepted by memcached.
+const MaxKeyLen = 250
+
+// validateKey checks that key can be stored in memcached.
+func validateKey(key string) error {
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if len(key) > MaxKeyLen {
+		return ErrKeyTooLong
+	}
+	for i := 0; i < len(key); i++ {
+		if !validKeyByte(key[i]) {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// validKeyByte returns false for whitespace and control characters.
+func validKeyByte(b byte) bool {
+	return b > ' ' && b != 0x7f
+}
+
+// prepareKey transforms the key of m using Config.KeyTransformer (if any) and
+// validates the result.
+func (c *Client) prepareKey(m *msg) error {
+	if c.config.KeyTransformer != nil {
+		m.key = c.config.KeyTransformer(m.key)
+	}
+	return validateKey(m.key)
+}
+
+// digestPrefixLen is the length of the part of an invalid key kept by
+// DigestKey: the rest of a key is a separator and a hex encoded SHA-256 digest.
+const digestPrefixLen = MaxKeyLen - 1 - 2*sha256.Size
+
+// DigestKey is a key transformer (see Config.KeyTransformer) making any key
+// safe to store. Valid keys are returned unchanged. Other keys are replaced by
+// their first bytes, with whitespace and control characters replaced by '_', a
+// '#' and a digest of the whole key, which keeps keys recognizable while being
+// stable and unique.
+func DigestKey(key string) string {
+	if validateKey(key) == nil {
+		return key
+	}
+
+	prefix := []byte(key)
+	if len(prefix) > digestPrefixLen {
+		prefix = prefix[:digestPrefixLen]
+	}
+	for i, b := range prefix {
+		if !validKeyByte(b) {
+			prefix[i] = '_'
+		}
+	}
+	digest := sha256.Sum256([]byte(key))
+	return string(prefix) + "#" + hex.EncodeToString(digest[:])
+}
+
+// derivedKey returns the key made of prefix, key and suffix, with key replaced
+// by its hex encoded SHA-256 digest if the result would be longer than
+// MaxKeyLen.
+func derivedKey(prefix, key, suffix string) string {
+	if len(prefix)+len(key)+len(suffix) > MaxKeyLen {
+		digest := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(digest[:])
+	}
+	return prefix + key + suffix
+}
+
+// hashKey returns the part of key used to choose its server: the content of
+// its hash tag (the first substring enclosed in braces, if not empty) if
+// Config.HashTags is set, so keys sharing a tag are stored on the same server.
+func (c *Client) hashKey(key string) string {
+	if !c.config.HashTags {
+		return key
+	}
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
@@ -0,0 +1,122 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateKey(t *testing.T) {
+	valid := []string{"foo", "user:42:profile", strings.Repeat("k", MaxKeyLen), "ünïcode"}
+	for _, key := range valid {
+		assertEqualf(t, nil, validateKey(key), "key should be valid: %q", key)
+	}
+
+	assertEqualf(t, ErrKeyTooLong, validateKey(strings.Repeat("k", MaxKeyLen+1)), "key should be too long")
+	invalid := []string{"", "foo bar", "foo\tbar", "foo\nbar", "foo\x00", "foo\x7f"}
+	for _, key := range invalid {
+		assertEqualf(t, ErrInvalidKey, validateKey(key), "key should be invalid: %q", key)
+	}
+}
+
+func TestInvalidKeyNotSent(t *testing.T) {
+	fc := newFakeCluster()
+	c := fc.client("a", DefaultConfig())
+
+	_, err := c.Set("foo bar", "baz", 0, 0, 0)
+	assertEqualf(t, ErrInvalidKey, err, "expected invalid key: %v", err)
+	_, _, _, err = c.Get(strings.Repeat("k", 300))
+	assertEqualf(t, ErrKeyTooLong, err, "expected key too long: %v", err)
+	assertEqualf(t, 0, fc.server("a").ops, "no request should reach the server")
+}
+
+func TestDigestKey(t *testing.T) {
+	assertEqualf(t, "foo", DigestKey("foo"), "valid keys should be unchanged")
+
+	long := strings.Repeat("k", 1000)
+	keys := []string{"foo bar", "foo\nbar", long, long + "x"}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		d := DigestKey(key)
+		assertEqualf(t, nil, validateKey(d), "digested key should be valid: %q", d)
+		assertEqualf(t, d, DigestKey(key), "digest should be stable")
+		assertTruef(t, !seen[d], "digest collision for %q", key)
+		seen[d] = true
+	}
+	assertTruef(t, strings.HasPrefix(DigestKey("foo bar"), "foo_bar#"), "prefix should be kept: %q", DigestKey("foo bar"))
+
+	config := DefaultConfig()
+	config.KeyTransformer = DigestKey
+	c := newFakeCluster().client("a", config)
+	_, err := c.Set(long, "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err := c.Get(long)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %s", v)
+}
+
+func TestDerivedKeys(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.ChunkSize = 16
+	config.LoadLockTTL = time.Second
+	c := fc.client("a", config)
+	key := strings.Repeat("k", 240)
+
+	// the lock is taken despite its key being longer than the key
+	var locked bool
+	_, err := c.GetOrLoad(key, 0, func() (string, error) {
+		_, ok := fc.server("a").get(derivedKey("mc:load:", key, ""))
+		locked = ok
+		return "loaded", nil
+	})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, locked, "lock should be taken")
+
+	big := strings.Repeat("x", 100)
+	_, err = c.Set(key, big, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err := c.Get(key)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, v == big, "chunked value should be read")
+
+	ns := c.Namespace(strings.Repeat("n", 250))
+	_, err = ns.Set(key, "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = ns.Get(key)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %s", v)
+
+	for _, k := range fc.server("a").keys() {
+		assertEqualf(t, nil, validateKey(k), "derived key should be valid: %q", k)
+	}
+}
+
+func TestHashTags(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	c := fc.client("a b c d e", config)
+	assertEqualf(t, "{user:42}:profile", c.hashKey("{user:42}:profile"), "hash tags should be disabled by default")
+
+	config.HashTags = true
+	tags := map[string]string{
+		"{user:42}:profile": "user:42",
+		"x{a}{b}":           "a",
+		"{}:foo":            "{}:foo",
+		"{foo":              "{foo",
+		"foo}{":             "foo}{",
+		"plain":             "plain",
+	}
+	for key, tag := range tags {
+		assertEqualf(t, tag, c.hashKey(key), "wrong hash tag for %q", key)
+	}
+
+	// all keys of an entity are on the same server
+	servers := make(map[*server]bool)
+	for _, field := range []string{"profile", "prefs", "friends", "avatar", "settings", "history"} {
+		s, err := c.getServer("{user:42}:" + field)
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		servers[s] = true
+	}
+	assertEqualf(t, 1, len(servers), "keys sharing a tag should be on a single server")
+}
@@ -0,0 +1,109 @@
+package mc
+
+// Read-through caching.
+//
+// GetOrLoad serves values from the cache and loads missing ones with a loader
+// function, writing them back. Concurrent misses for the same key within the
+// process are coalesced into a single loader call. With Config.LoadLockTTL set,
+// a lock taken with Add in the cache also coalesces loads across processes:
+// processes that don't get the lock poll the cache for the value while the lock
+// is held, and load it themselves if it doesn't show up in time.
+
+import (
+	"sync"
+	"time"
+)
+
+// loadLockPoll is the interval at which processes waiting for another one to
+// load a value poll the cache.
+const loadLockPoll = 50 * time.Millisecond
+
+var errLoaderPanic = &Error{StatusUnknownError, "mc: loader panicked", nil}
+
+// loadCall is a loader call in progress or completed.
+type loadCall struct {
+	wg  sync.WaitGroup
+	val string
+	err error
+}
+
+// loadGroup coalesces concurrent calls for the same key.
+type loadGroup struct {
+	lock  sync.Mutex
+	calls map[string]*loadCall
+}
+
+// do calls fn for key, unless a call for key is already in progress, in which
+// case it waits for it and returns its result.
+func (g *loadGroup) do(key string, fn func() (string, error)) (string, error) {
+	g.lock.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := &loadCall{err: errLoaderPanic}
+	call.wg.Add(1)
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		call.wg.Done()
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err
+}
+
+// GetOrLoad retrieves the value of key from the cache. On a miss, the value is
+// loaded with loader and set in the cache with expiration ttl. Errors of the
+// cache are treated as misses, so callers are served by loader while the cache
+// is unavailable. Only errors of loader are returned.
+func (c *Client) GetOrLoad(key string, ttl uint32, loader func() (string, error)) (string, error) {
+	val, _, _, err := c.Get(key)
+	if err == nil {
+		return val, nil
+	}
+	return c.loads.do(key, func() (string, error) {
+		return c.load(key, ttl, loader)
+	})
+}
+
+// load loads the value of key, under the cache lock if enabled, and writes it
+// back.
+func (c *Client) load(key string, ttl uint32, loader func() (string, error)) (string, error) {
+	if c.config.LoadLockTTL > 0 {
+		lockKey := derivedKey("mc:load:", key, "")
+		lockTTL := uint32((c.config.LoadLockTTL + time.Second - 1) / time.Second)
+		lockCAS, err := c.Add(lockKey, "", 0, lockTTL)
+		switch err {
+		case nil:
+			defer c.DelCAS(lockKey, lockCAS)
+			// the previous holder may have just set the value
+			if val, _, _, err := c.Get(key); err == nil {
+				return val, nil
+			}
+		case ErrKeyExists:
+			// another process is loading the value
+			deadline := time.Now().Add(c.config.LoadLockTTL)
+			for time.Now().Before(deadline) {
+				time.Sleep(loadLockPoll)
+				if val, _, _, err := c.Get(key); err == nil {
+					return val, nil
+				}
+			}
+		}
+	}
+
+	val, err := loader()
+	if err != nil {
+		return "", err
+	}
+	c.Set(key, val, 0, ttl, 0)
+	return val, nil
+}
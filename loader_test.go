@@ -0,0 +1,88 @@
+package mc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	fc, c := newTestClient(nil)
+
+	var calls int32
+	loader := func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "bar", nil
+	}
+
+	type result struct {
+		val string
+		err error
+	}
+	results := make(chan result, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrLoad("foo", 0, loader)
+			results <- result{v, err}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	for r := range results {
+		assertEqualf(t, nil, r.err, "unexpected error: %v", r.err)
+		assertEqualf(t, "bar", r.val, "wrong value: %v", r.val)
+	}
+	assertEqualf(t, int32(1), atomic.LoadInt32(&calls), "concurrent misses should be coalesced: %d calls", calls)
+
+	it, ok := fc.server("a").get("foo")
+	assertTruef(t, ok && it.val == "bar", "loaded value should be written back")
+	v, err := c.GetOrLoad("foo", 0, loader)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, int32(1), atomic.LoadInt32(&calls), "hit shouldn't call loader")
+
+	// loader errors are returned and not cached
+	errLoad := errors.New("load failed")
+	_, err = c.GetOrLoad("baz", 0, func() (string, error) { return "", errLoad })
+	assertEqualf(t, errLoad, err, "loader error should be returned: %v", err)
+	_, ok = fc.server("a").get("baz")
+	assertTruef(t, !ok, "failed load shouldn't be cached")
+
+	// a cache down serves loaded values
+	fc.server("a").setDown(true)
+	config := DefaultConfig()
+	config.Failover = false
+	v, err = fc.client("a", config).GetOrLoad("foo", 0, func() (string, error) { return "db", nil })
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "db", v, "wrong value: %v", v)
+}
+
+func TestGetOrLoadLock(t *testing.T) {
+	config := DefaultConfig()
+	config.LoadLockTTL = time.Second
+	fc, c := newTestClient(config)
+
+	// the lock is released after loading
+	_, err := c.GetOrLoad("foo", 0, func() (string, error) { return "bar", nil })
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	_, ok := fc.server("a").get("mc:load:foo")
+	assertTruef(t, !ok, "lock should be released")
+
+	// another process holding the lock, we wait for its value
+	other := fc.client("a", DefaultConfig())
+	_, err = other.Add("mc:load:baz", "", 0, 1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		other.Set("baz", "theirs", 0, 0, 0)
+	}()
+	v, err := c.GetOrLoad("baz", 0, func() (string, error) { return "ours", nil })
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "theirs", v, "should use the value of the lock holder: %v", v)
+}
@@ -0,0 +1,116 @@
+package mc
+
+// Distributed locks.
+//
+// A lock is a key added with a random token, so it's held by a single client
+// until it expires. The holder refreshes and releases it with the CAS returned
+// by its last write, so a holder whose lock expired and was taken by another
+// client can't refresh or release the new holder's lock.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"time"
+)
+
+// Backoff between attempts of LockWait.
+const (
+	lockWaitMin = 10 * time.Millisecond
+	lockWaitMax = time.Second
+)
+
+// Lock is a lock held in the cache, see Client.Lock.
+type Lock struct {
+	client *Client
+	// mirror holds a copy of the lock, see DualClient.Lock
+	mirror *Client
+	key    string
+	token  string
+	ttl    uint32
+	cas    uint64
+}
+
+// Lock takes the lock key for ttl seconds. ErrLocked is returned if the lock is
+// held by someone else.
+func (c *Client) Lock(key string, ttl uint32) (*Lock, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, wrapError(StatusUnknownError, err)
+	}
+	l := &Lock{client: c, key: key, token: hex.EncodeToString(b[:]), ttl: ttl}
+
+	cas, err := c.Add(key, l.token, 0, ttl)
+	if err == ErrKeyExists {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	l.cas = cas
+	return l, nil
+}
+
+// LockWait is Lock but waits for the lock to be released, retrying with a
+// growing backoff until ctx is done.
+func (c *Client) LockWait(ctx context.Context, key string, ttl uint32) (*Lock, error) {
+	return lockWait(ctx, func() (*Lock, error) {
+		return c.Lock(key, ttl)
+	})
+}
+
+// lockWait calls lock until it doesn't return ErrLocked, with a growing
+// backoff, until ctx is done.
+func lockWait(ctx context.Context, lock func() (*Lock, error)) (*Lock, error) {
+	backoff := lockWaitMin
+	for {
+		l, err := lock()
+		if err != ErrLocked {
+			return l, err
+		}
+
+		wait := backoff/2 + time.Duration(mrand.Int63n(int64(backoff/2)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > lockWaitMax {
+			backoff = lockWaitMax
+		}
+	}
+}
+
+// Key returns the key of the lock.
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Refresh extends the lock for its ttl from now. ErrLockLost is returned if
+// the lock expired or was taken by someone else.
+func (l *Lock) Refresh() error {
+	cas, err := l.client.Set(l.key, l.token, 0, l.ttl, l.cas)
+	if err == ErrKeyExists || err == ErrNotFound {
+		return ErrLockLost
+	} else if err != nil {
+		return err
+	}
+	l.cas = cas
+	if l.mirror != nil {
+		l.mirror.Set(l.key, l.token, 0, l.ttl, 0)
+	}
+	return nil
+}
+
+// Unlock releases the lock. ErrLockLost is returned if the lock expired or was
+// taken by someone else, who still holds it.
+func (l *Lock) Unlock() error {
+	err := l.client.DelCAS(l.key, l.cas)
+	if err == ErrKeyExists || err == ErrNotFound {
+		return ErrLockLost
+	}
+	if err == nil && l.mirror != nil {
+		l.mirror.Del(l.key)
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	fc := newFakeCluster()
+	c := fc.client("a", DefaultConfig())
+	other := fc.client("a", DefaultConfig())
+
+	l, err := c.Lock("lock", 10)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "lock", l.Key(), "wrong key: %v", l.Key())
+	_, err = other.Lock("lock", 10)
+	assertEqualf(t, ErrLocked, err, "lock should be held: %v", err)
+
+	assertEqualf(t, nil, l.Refresh(), "refresh should succeed")
+	assertEqualf(t, nil, l.Unlock(), "unlock should succeed")
+	_, ok := fc.server("a").get("lock")
+	assertTruef(t, !ok, "lock should be released")
+
+	// a holder can't release the lock of another one
+	l, _ = c.Lock("lock", 10)
+	fc.server("a").delete("lock") // expired
+	l2, err := other.Lock("lock", 10)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, ErrLockLost, l.Refresh(), "refresh of lost lock should fail")
+	assertEqualf(t, ErrLockLost, l.Unlock(), "unlock of lost lock should fail")
+	_, ok = fc.server("a").get("lock")
+	assertTruef(t, ok, "lock of the new holder should be kept")
+	assertEqualf(t, nil, l2.Unlock(), "unlock should succeed")
+	assertEqualf(t, ErrLockLost, l2.Unlock(), "second unlock should fail")
+}
+
+func TestLockWait(t *testing.T) {
+	fc := newFakeCluster()
+	c := fc.client("a", DefaultConfig())
+	other := fc.client("a", DefaultConfig())
+
+	l, err := other.Lock("lock", 10)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Unlock()
+	}()
+	l2, err := c.LockWait(context.Background(), "lock", 10)
+	assertEqualf(t, nil, err, "lock should be taken once released: %v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = other.LockWait(ctx, "lock", 10)
+	assertEqualf(t, context.DeadlineExceeded, err, "wait should stop with its context: %v", err)
+	l2.Unlock()
+}
@@ -0,0 +1,54 @@
+package mc
+
+import (
+	"sync/atomic"
+)
+
+// Metrics is a snapshot of the counters maintained by a client, e.g. to export
+// them to a monitoring system.
+type Metrics struct {
+	// ChecksumMismatches counts values read whose checksum didn't match.
+	ChecksumMismatches uint64
+	// NearCacheHits and NearCacheMisses count the lookups of Get in the near
+	// cache.
+	NearCacheHits   uint64
+	NearCacheMisses uint64
+	// UpdateConflicts counts the attempts of Update that conflicted with
+	// another write.
+	UpdateConflicts uint64
+	// ReadRepairs counts the copies of replicated keys rewritten by read
+	// repair.
+	ReadRepairs uint64
+	// HotKeyHits counts the reads of hot keys served from the local cache.
+	HotKeyHits uint64
+	// Hedges counts the hedged reads sent, and HedgeWins the ones answered
+	// first.
+	Hedges    uint64
+	HedgeWins uint64
+}
+
+// clientMetrics holds the counters of a client, updated atomically.
+type clientMetrics struct {
+	checksumMismatches uint64
+	nearCacheHits      uint64
+	nearCacheMisses    uint64
+	updateConflicts    uint64
+	readRepairs        uint64
+	hotKeyHits         uint64
+	hedges             uint64
+	hedgeWins          uint64
+}
+
+// Metrics returns a snapshot of the client's counters.
+func (c *Client) Metrics() Metrics {
+	return Metrics{
+		ChecksumMismatches: atomic.LoadUint64(&c.metrics.checksumMismatches),
+		NearCacheHits:      atomic.LoadUint64(&c.metrics.nearCacheHits),
+		NearCacheMisses:    atomic.LoadUint64(&c.metrics.nearCacheMisses),
+		UpdateConflicts:    atomic.LoadUint64(&c.metrics.updateConflicts),
+		ReadRepairs:        atomic.LoadUint64(&c.metrics.readRepairs),
+		HotKeyHits:         atomic.LoadUint64(&c.metrics.hotKeyHits),
+		Hedges:             atomic.LoadUint64(&c.metrics.hedges),
+		HedgeWins:          atomic.LoadUint64(&c.metrics.hedgeWins),
+	}
+}
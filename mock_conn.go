@@ -12,7 +12,6 @@ type mockConn struct {
 	serverId   string
 	successMod int
 	counter    int
-	backupMsg  msg
 }
 
 // newMockConn creates a new mockConn which allows for a certain failure pattern
@@ -52,13 +51,14 @@ func (mc *mockConn) performStats(m *msg) (McStats, error) {
 	return nil, nil
 }
 
-func (mc *mockConn) quit(m *msg) {
-}
-
-func (mc *mockConn) backup(m *msg) {
-	backupMsg(m, &mc.backupMsg)
+func (mc *mockConn) performBatch(ms []*msg) error {
+	for _, m := range ms {
+		if err := mc.perform(m); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (mc *mockConn) restore(m *msg) {
-	restoreMsg(m, &mc.backupMsg)
+func (mc *mockConn) quit(m *msg) {
 }
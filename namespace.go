@@ -0,0 +1,190 @@
+package mc
+
+// Namespaces with O(1) invalidation.
+//
+// Keys of a namespace are prefixed with the namespace name (preceded by its
+// length, so names containing ':' can't collide) and its current generation, a
+// counter stored in memcached. Invalidating a namespace bumps
+// its generation so that all keys stored under the previous one become
+// unreachable at once; they are then left to expire or to be evicted.
+//
+// The generation counter is created with the current time in nanoseconds, so
+// that if it is ever evicted the new generation doesn't revive old keys. Note
+// that every operation on a namespace costs an extra round trip to read the
+// generation. It is read with a Get, which is retried, and only created with
+// an Incr if missing.
+
+import (
+	"strconv"
+	"time"
+)
+
+// Namespace is a view of a Client that scopes all keys to a namespace. Use
+// Client.Namespace to create one.
+type Namespace struct {
+	client namespaceClient
+	name   string
+}
+
+// namespaceClient is the client of a Namespace, a Client or a DualClient.
+type namespaceClient interface {
+	Cache
+	// generation increments the generation counter key by delta and returns
+	// it, creating it if needed.
+	generation(key string, delta uint64) (uint64, error)
+}
+
+// Namespace returns a view of the client that scopes all keys to the namespace
+// name.
+func (c *Client) Namespace(name string) *Namespace {
+	return &Namespace{client: c, name: name}
+}
+
+// Name returns the name of the namespace.
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// generationKey returns the key of the counter holding the generation.
+func (ns *Namespace) generationKey() string {
+	return derivedKey("mc:ns:", ns.name, "")
+}
+
+// incrGeneration increments the generation by delta and returns it, creating
+// it if needed.
+func (ns *Namespace) incrGeneration(delta uint64) (uint64, error) {
+	return ns.client.generation(ns.generationKey(), delta)
+}
+
+// generation implements namespaceClient.
+func (c *Client) generation(key string, delta uint64) (uint64, error) {
+	if delta == 0 {
+		val, _, err := c.getCounter(key)
+		if err == nil {
+			if gen, err := strconv.ParseUint(val, 10, 64); err == nil {
+				return gen, nil
+			}
+		} else if err != ErrNotFound {
+			return 0, err
+		}
+	}
+	// Incr creates the counter atomically if missing
+	gen, _, err := c.Incr(key, delta, uint64(time.Now().UnixNano()), 0, 0)
+	return gen, err
+}
+
+// key returns the key used to store key in the current generation.
+func (ns *Namespace) key(key string) (string, error) {
+	gen, err := ns.incrGeneration(0)
+	if err != nil {
+		return "", err
+	}
+	// the whole key is digested if too long, as the name may be long as well
+	prefix := strconv.Itoa(len(ns.name)) + ":" + ns.name + ":" + strconv.FormatUint(gen, 36) + ":"
+	return derivedKey("", prefix+key, ""), nil
+}
+
+// Invalidate makes all keys currently in the namespace unreachable.
+func (ns *Namespace) Invalidate() error {
+	_, err := ns.incrGeneration(1)
+	return err
+}
+
+// Get retrieves a value from the namespace.
+func (ns *Namespace) Get(key string) (val string, flags uint32, cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Get(key)
+}
+
+// GAT (get and touch) retrieves the value associated with the key in the
+// namespace and updates its expiration time.
+func (ns *Namespace) GAT(key string, exp uint32) (val string, flags uint32, cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.GAT(key, exp)
+}
+
+// Touch updates the expiration time on a key/value pair in the namespace.
+func (ns *Namespace) Touch(key string, exp uint32) (cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Touch(key, exp)
+}
+
+// Set sets a key/value pair in the namespace.
+func (ns *Namespace) Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Set(key, val, flags, exp, ocas)
+}
+
+// Replace replaces an existing key/value in the namespace. Fails if key doesn't
+// already exist in the namespace.
+func (ns *Namespace) Replace(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Replace(key, val, flags, exp, ocas)
+}
+
+// Add adds a new key/value to the namespace. Fails if the key already exists in
+// the namespace.
+func (ns *Namespace) Add(key, val string, flags, exp uint32) (cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Add(key, val, flags, exp)
+}
+
+// Incr increments a value in the namespace. See Client.Incr.
+func (ns *Namespace) Incr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Incr(key, delta, init, exp, ocas)
+}
+
+// Decr decrements a value in the namespace. See Client.Decr.
+func (ns *Namespace) Decr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Decr(key, delta, init, exp, ocas)
+}
+
+// Append appends the value to the existing value for the key in the namespace.
+// An error is thrown if the key doesn't exist.
+func (ns *Namespace) Append(key, val string, ocas uint64) (cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Append(key, val, ocas)
+}
+
+// Prepend prepends the value to the existing value for the key in the
+// namespace. An error is thrown if the key doesn't exist.
+func (ns *Namespace) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.Prepend(key, val, ocas)
+}
+
+// Del deletes a key/value from the namespace.
+func (ns *Namespace) Del(key string) (err error) {
+	return ns.DelCAS(key, 0)
+}
+
+// DelCAS deletes a key/value from the namespace but only if the CAS specified
+// matches the CAS in the cache.
+func (ns *Namespace) DelCAS(key string, cas uint64) (err error) {
+	if key, err = ns.key(key); err != nil {
+		return
+	}
+	return ns.client.DelCAS(key, cas)
+}
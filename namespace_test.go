@@ -0,0 +1,77 @@
+package mc
+
+import (
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	c := newFakeCluster().client("a,b", DefaultConfig())
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+		Val2 = "baz"
+	)
+
+	ns1 := c.Namespace("user:42")
+	ns2 := c.Namespace("user:43")
+
+	_, err := ns1.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = ns2.Set(Key1, Val2, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// namespaces are isolated from each other and from the client
+	v, _, _, err := ns1.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "wrong value: %s", v)
+	v, _, _, err = ns2.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "wrong value: %s", v)
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "key shouldn't exist outside namespace: %v", err)
+
+	// invalidation only affects its namespace
+	err = ns1.Invalidate()
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = ns1.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "key should be invalidated: %v", err)
+	v, _, _, err = ns2.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "wrong value: %s", v)
+
+	// namespace is usable after invalidation
+	_, err = ns1.Add(Key1, Val2, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = c.Namespace("user:42").Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "wrong value: %s", v)
+
+	err = ns1.Del(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = ns1.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "key should be deleted: %v", err)
+}
+
+func TestNamespaceKeys(t *testing.T) {
+	fc := newFakeCluster()
+	c := fc.client("a", DefaultConfig())
+
+	// names containing ':' don't collide, even with the same generation
+	ns1, ns2 := c.Namespace("a"), c.Namespace("a:1")
+	fc.server("a").set(ns1.generationKey(), "1", 0)
+	fc.server("a").set(ns2.generationKey(), "1", 0)
+	_, err := ns1.Set("1:b", "v1", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = ns2.Get("b")
+	assertEqualf(t, ErrNotFound, err, "namespaces shouldn't collide: %v", err)
+
+	// the generation is read, and only created when missing
+	k1, err := ns1.key("b")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "1:a:1:b", k1, "wrong key: %v", k1)
+	ns3 := c.Namespace("new")
+	k1, _ = ns3.key("b")
+	k2, _ := ns3.key("b")
+	assertEqualf(t, k1, k2, "generation shouldn't change: %v, %v", k1, k2)
+}
@@ -0,0 +1,177 @@
+package mc
+
+// Near cache.
+//
+// With Config.NearCacheSize set, values read by Get are kept in a bounded
+// in-process LRU cache for up to Config.NearCacheTTL, so hot keys are served
+// without a round trip. The client updates the near cache with its own writes
+// and removes the keys it changes otherwise (e.g. Append, Incr or Del), while
+// changes made by other clients are only seen once entries expire. Keys are
+// invalidated once the writes changing them completed, and values read or
+// written before the invalidation of their key started aren't stored, so a
+// slow read racing with a write can't bring back a stale value. Entries are
+// only replaced by values with a higher CAS.
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// nearEntryOverhead approximates the memory used by an entry besides its
+	// key and value.
+	nearEntryOverhead = 96
+	// nearStripes is the number of invalidation counters keys are spread
+	// over.
+	nearStripes = 256
+)
+
+type nearEntry struct {
+	key     string
+	val     string
+	flags   uint32
+	cas     uint64
+	expires time.Time
+}
+
+func (e *nearEntry) size() int {
+	return len(e.key) + len(e.val) + nearEntryOverhead
+}
+
+// nearCache is a LRU cache bounded in bytes. A nil nearCache is disabled, and
+// a nil metrics isn't updated.
+type nearCache struct {
+	lock     sync.Mutex
+	maxBytes int
+	ttl      time.Duration
+	bytes    int
+	lru      *list.List
+	entries  map[string]*list.Element
+	metrics  *clientMetrics
+	// invalidations counts the invalidations of the keys of each stripe
+	invalidations [nearStripes]uint64
+}
+
+// nearStripe returns the stripe of key.
+func nearStripe(key string) int {
+	return int(fnv1a32(key) % nearStripes)
+}
+
+func newNearCache(maxBytes int, ttl time.Duration, metrics *clientMetrics) *nearCache {
+	return &nearCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		metrics:  metrics,
+	}
+}
+
+// get returns the entry of key if it hasn't expired.
+func (nc *nearCache) get(key string) (val string, flags uint32, cas uint64, ok bool) {
+	if nc == nil {
+		return "", 0, 0, false
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	el, ok := nc.entries[key]
+	if ok && !time.Now().Before(el.Value.(*nearEntry).expires) {
+		nc.remove(el)
+		ok = false
+	}
+	if !ok {
+		if nc.metrics != nil {
+			atomic.AddUint64(&nc.metrics.nearCacheMisses, 1)
+		}
+		return "", 0, 0, false
+	}
+	if nc.metrics != nil {
+		atomic.AddUint64(&nc.metrics.nearCacheHits, 1)
+	}
+	nc.lru.MoveToFront(el)
+	e := el.Value.(*nearEntry)
+	return e.val, e.flags, e.cas, true
+}
+
+// generation returns the invalidation counter of key, to be read before a
+// request whose result is given to put.
+func (nc *nearCache) generation(key string) uint64 {
+	if nc == nil {
+		return 0
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	return nc.invalidations[nearStripe(key)]
+}
+
+// put stores the value of key, unless an entry with a higher CAS exists or key
+// (or another key of its stripe) was invalidated since generation returned gen.
+// exp is the expiration of the value in the cache, which shortens the TTL of
+// the entry if needed.
+func (nc *nearCache) put(key, val string, flags uint32, cas uint64, exp uint32, gen uint64) {
+	if nc == nil {
+		return
+	}
+	ttl := nc.ttl
+	if exp > 0 && exp <= 60*60*24*30 && time.Duration(exp)*time.Second < ttl {
+		ttl = time.Duration(exp) * time.Second
+	}
+	e := &nearEntry{key: key, val: val, flags: flags, cas: cas, expires: time.Now().Add(ttl)}
+	if e.size() > nc.maxBytes {
+		nc.invalidate(key)
+		return
+	}
+
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if nc.invalidations[nearStripe(key)] != gen {
+		return
+	}
+	if el, ok := nc.entries[key]; ok {
+		if el.Value.(*nearEntry).cas > cas {
+			return
+		}
+		nc.remove(el)
+	}
+	nc.entries[key] = nc.lru.PushFront(e)
+	nc.bytes += e.size()
+	for nc.bytes > nc.maxBytes {
+		nc.remove(nc.lru.Back())
+	}
+}
+
+// invalidate removes the entry of key.
+func (nc *nearCache) invalidate(key string) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	nc.invalidations[nearStripe(key)]++
+	if el, ok := nc.entries[key]; ok {
+		nc.remove(el)
+	}
+}
+
+// clear removes all entries.
+func (nc *nearCache) clear() {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	nc.lru.Init()
+	nc.entries = make(map[string]*list.Element)
+	nc.bytes = 0
+	for i := range nc.invalidations {
+		nc.invalidations[i]++
+	}
+}
+
+func (nc *nearCache) remove(el *list.Element) {
+	e := nc.lru.Remove(el).(*nearEntry)
+	delete(nc.entries, e.key)
+	nc.bytes -= e.size()
+}
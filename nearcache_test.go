@@ -0,0 +1,98 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNearCache(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.NearCacheSize = 1 << 20
+	config.NearCacheTTL = time.Minute
+	c := fc.client("a", config)
+	srv := fc.server("a")
+
+	const FLAGS uint32 = 42
+	_, err := c.Set("foo", "bar", FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// our own write is served locally
+	ops := srv.ops
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertEqualf(t, ops, srv.ops, "Get should be served by the near cache")
+
+	// writes of other clients are only seen once entries expire
+	other := fc.client("a", DefaultConfig())
+	other.Set("foo", "baz", 0, 0, 0)
+	v, _, _, _ = c.Get("foo")
+	assertEqualf(t, "bar", v, "near cache should serve its entry: %v", v)
+
+	// changes of our own are applied
+	_, err = c.Append("foo", "!", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, _ = c.Get("foo")
+	assertEqualf(t, "baz!", v, "append should invalidate: %v", v)
+	c.Del("foo")
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrNotFound, err, "delete should invalidate: %v", err)
+
+	other.Set("foo", "qux", 0, 0, 0)
+	c.Get("foo")
+	c.Flush(0)
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrNotFound, err, "flush should clear: %v", err)
+
+	// failed CAS writes invalidate
+	other.Set("foo", "a", 0, 0, 0)
+	_, _, cas, _ := c.Get("foo")
+	other.Set("foo", "b", 0, 0, 0)
+	_, err = c.Set("foo", "c", 0, 0, cas)
+	assertEqualf(t, ErrKeyExists, err, "expected CAS mismatch: %v", err)
+	v, _, _, _ = c.Get("foo")
+	assertEqualf(t, "b", v, "failed write should invalidate: %v", v)
+
+	m := c.Metrics()
+	assertTruef(t, m.NearCacheHits >= 2 && m.NearCacheMisses >= 3, "wrong metrics: %+v", m)
+}
+
+func TestNearCacheBounds(t *testing.T) {
+	nc := newNearCache(1000, time.Minute, &clientMetrics{})
+	val := strings.Repeat("x", 300)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		nc.put(key, val, 0, 1, 0, nc.generation(key))
+	}
+	_, _, _, ok := nc.get("a")
+	assertTruef(t, !ok, "least recently used entry should be evicted")
+	_, _, _, ok = nc.get("d")
+	assertTruef(t, ok, "recent entry should be kept")
+	assertTruef(t, nc.bytes <= 1000, "size limit exceeded: %d", nc.bytes)
+
+	nc.put("big", strings.Repeat("x", 2000), 0, 1, 0, nc.generation("big"))
+	_, _, _, ok = nc.get("big")
+	assertTruef(t, !ok, "entry above the limit shouldn't be kept")
+
+	// entries are only replaced by values with a higher CAS
+	nc.put("d", "new", 0, 5, 0, nc.generation("d"))
+	nc.put("d", "old", 0, 4, 0, nc.generation("d"))
+	v, _, _, _ := nc.get("d")
+	assertEqualf(t, "new", v, "stale value shouldn't replace entry: %v", v)
+
+	// values read before an invalidation aren't stored
+	gen := nc.generation("d")
+	nc.invalidate("d")
+	nc.put("d", "stale", 0, 6, 0, gen)
+	_, _, _, ok = nc.get("d")
+	assertTruef(t, !ok, "value read before the invalidation shouldn't be stored")
+
+	// entries expire after the TTL
+	nc.ttl = 10 * time.Millisecond
+	nc.put("e", "v", 0, 1, 0, nc.generation("e"))
+	time.Sleep(20 * time.Millisecond)
+	_, _, _, ok = nc.get("e")
+	assertTruef(t, !ok, "entry should expire")
+}
@@ -2,6 +2,8 @@ package mc
 
 // Deal with the protocol specification of Memcached.
 
+import "io"
+
 // Error represents a MemCache error (including the status code). All function
 // in mc return error values of this type, despite the functions using the plain
 // error type. You can safely cast all error types returned by mc to *Error. If
@@ -39,6 +41,22 @@ var (
 	ErrUnknownError   = &Error{StatusUnknownError, "mc: unknown error from server", nil}
 )
 
+// Errors detected by the client itself, without involving the server.
+var (
+	ErrReservedFlags     = &Error{StatusInvalidArgs, "mc: flags use bits reserved by the client", nil}
+	ErrKeyTooLong        = &Error{StatusInvalidArgs, "mc: key longer than 250 bytes", nil}
+	ErrInvalidKey        = &Error{StatusInvalidArgs, "mc: key is empty or contains whitespace or control characters", nil}
+	ErrUnknownCodec      = &Error{StatusUnknownError, "mc: value not encoded with a known codec", nil}
+	ErrUnknownCompressor = &Error{StatusUnknownError, "mc: value compressed with an unknown compressor", nil}
+	ErrDecrypt           = &Error{StatusUnknownError, "mc: value can't be decrypted (unknown key or authentication failed)", nil}
+	ErrChecksumMismatch  = &Error{StatusUnknownError, "mc: value checksum mismatch", nil}
+	ErrRawFlags          = &Error{StatusInvalidArgs, "mc: feature recorded in the flags used with Config.RawFlags", nil}
+	ErrNotStreamable     = &Error{StatusUnknownError, "mc: value chunked or encoded by the client can't be streamed", nil}
+	ErrLocked            = &Error{StatusKeyExists, "mc: locked by someone else", nil}
+	ErrLockLost          = &Error{StatusUnknownError, "mc: lock expired or taken by someone else", nil}
+	ErrNoRoute           = &Error{StatusUnknownError, "mc: no pool for key", nil}
+)
+
 // Status Codes that may be returned (usually as part of an Error).
 const (
 	StatusOK             = uint16(0)
@@ -173,6 +191,19 @@ type msg struct {
 
 	key string // [m..(n-1)] Key (as needed, length in header)
 	val string // [n..x] Value (as needed, length in header)
+
+	// Streaming: when set, the request value is copied from valReader (valLen
+	// bytes) instead of val, and a successful response value is copied into
+	// valWriter instead of being stored in val. Streamed messages can't be
+	// replayed, so they are never retried.
+	valReader io.Reader
+	valLen    int64
+	valWriter io.Writer
+}
+
+// streaming returns true if the request or response value is streamed.
+func (m *msg) streaming() bool {
+	return m.valReader != nil || m.valWriter != nil
 }
 
 // Memcache stats
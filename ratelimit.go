@@ -0,0 +1,244 @@
+package mc
+
+// Rate limiting.
+//
+// A RateLimiter counts requests with Incr, so limits are shared by all clients
+// of the cluster. Requests denied are not counted against the limit.
+//
+// FixedWindow counts requests in windows aligned on multiples of the window
+// duration. SlidingWindow also counts them per window, but weights the count
+// of the previous window by how much of it still overlaps the sliding window
+// ending now, which smooths bursts at window boundaries. TokenBucket refills a
+// bucket of limit tokens at a rate of limit tokens per window, each request
+// taking one: it tracks the position of the bucket on a timeline of tokens
+// (the number of tokens refilled since the Unix epoch) in a counter per window
+// carried over from the previous one. A bucket full for a while is moved up to
+// the timeline with a CAS before counting, so concurrent requests don't all
+// apply the move.
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// RateAlgorithm is the algorithm used by a RateLimiter.
+type RateAlgorithm int
+
+// Rate limiting algorithms.
+const (
+	FixedWindow RateAlgorithm = iota
+	SlidingWindow
+	TokenBucket
+)
+
+// RateResult is the outcome of a rate limited request.
+type RateResult struct {
+	// Allowed tells whether the request is within the limit.
+	Allowed bool
+	// Remaining is the number of requests still allowed now.
+	Remaining uint64
+	// ResetAt is when the limit is fully available again.
+	ResetAt time.Time
+}
+
+// RateLimiter limits the rate of requests to limit per window, for any number
+// of keys. The window is rounded to the second. It is safe for concurrent use.
+type RateLimiter struct {
+	client    *Client
+	algorithm RateAlgorithm
+	limit     uint64
+	window    time.Duration
+	now       func() time.Time
+}
+
+// NewRateLimiter creates a rate limiter counting requests in c.
+func NewRateLimiter(c *Client, algorithm RateAlgorithm, limit uint64, window time.Duration) *RateLimiter {
+	window = window.Round(time.Second)
+	if window < time.Second {
+		window = time.Second
+	}
+	return &RateLimiter{client: c, algorithm: algorithm, limit: limit, window: window, now: time.Now}
+}
+
+// Allow counts a request for key.
+func (rl *RateLimiter) Allow(key string) (RateResult, error) {
+	return rl.AllowN(key, 1)
+}
+
+// AllowN counts n requests for key, which are allowed or denied at once.
+func (rl *RateLimiter) AllowN(key string, n uint64) (RateResult, error) {
+	now := rl.now()
+	switch rl.algorithm {
+	case SlidingWindow:
+		return rl.slidingWindow(key, n, now)
+	case TokenBucket:
+		return rl.tokenBucket(key, n, now)
+	}
+	return rl.fixedWindow(key, n, now)
+}
+
+// windowKey returns the key of the counter of key for the window starting at
+// start.
+func (rl *RateLimiter) windowKey(key string, start time.Time) string {
+	return key + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// count adds n to the counter of the window starting at start, or creates it
+// with init. Counters expire once they aren't needed anymore.
+func (rl *RateLimiter) count(key string, start time.Time, n, init uint64) (uint64, error) {
+	exp := uint32(2*rl.window/time.Second) + 1
+	count, _, err := rl.client.Incr(rl.windowKey(key, start), n, init, exp, 0)
+	return count, err
+}
+
+// uncount removes n denied requests from the counter of the window starting at
+// start.
+func (rl *RateLimiter) uncount(key string, start time.Time, n uint64) {
+	rl.client.Decr(rl.windowKey(key, start), n, 0, 0xffffffff, 0)
+}
+
+// counter reads the counter of the window starting at start.
+func (rl *RateLimiter) counter(key string, start time.Time) (uint64, bool, error) {
+	val, _, err := rl.client.getCounter(rl.windowKey(key, start))
+	if err == ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	n, _ := strconv.ParseUint(val, 10, 64)
+	return n, true, nil
+}
+
+func (rl *RateLimiter) fixedWindow(key string, n uint64, now time.Time) (RateResult, error) {
+	start := now.Truncate(rl.window)
+	count, err := rl.count(key, start, n, n)
+	if err != nil {
+		return RateResult{}, err
+	}
+
+	res := RateResult{Allowed: count <= rl.limit, ResetAt: start.Add(rl.window)}
+	if !res.Allowed {
+		rl.uncount(key, start, n)
+		count -= n
+	}
+	if count < rl.limit {
+		res.Remaining = rl.limit - count
+	}
+	return res, nil
+}
+
+func (rl *RateLimiter) slidingWindow(key string, n uint64, now time.Time) (RateResult, error) {
+	start := now.Truncate(rl.window)
+	prev, _, err := rl.counter(key, start.Add(-rl.window))
+	if err != nil {
+		return RateResult{}, err
+	}
+	count, err := rl.count(key, start, n, n)
+	if err != nil {
+		return RateResult{}, err
+	}
+
+	overlap := 1 - float64(now.Sub(start))/float64(rl.window)
+	weighted := func(count uint64) uint64 {
+		return uint64(math.Ceil(float64(prev)*overlap)) + count
+	}
+	res := RateResult{Allowed: weighted(count) <= rl.limit, ResetAt: start.Add(rl.window)}
+	if !res.Allowed {
+		rl.uncount(key, start, n)
+		count -= n
+	}
+	if count > 0 {
+		// the requests of the current window weigh until the end of the next
+		res.ResetAt = res.ResetAt.Add(rl.window)
+	}
+	if w := weighted(count); w < rl.limit {
+		res.Remaining = rl.limit - w
+	}
+	return res, nil
+}
+
+// catchUpAttempts is the number of times the position of a bucket is read
+// before giving up catching up with the timeline.
+const catchUpAttempts = 3
+
+// catchUp moves the position of a bucket full for a while, which lags behind
+// the timeline, up to refilled so it doesn't accumulate more than a full bucket.
+// The move is conditioned on the CAS of the position read, so only one of
+// concurrent requests applies it. It returns whether the counter of the window
+// starting at start exists.
+func (rl *RateLimiter) catchUp(key string, start time.Time, refilled uint64) (bool, error) {
+	for i := 0; i < catchUpAttempts; i++ {
+		val, cas, err := rl.client.getCounter(rl.windowKey(key, start))
+		if err == ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		pos, _ := strconv.ParseUint(val, 10, 64)
+		if pos >= refilled {
+			return true, nil
+		}
+		_, _, err = rl.client.Incr(rl.windowKey(key, start), refilled-pos, 0, 0xffffffff, cas)
+		switch err {
+		case nil:
+			return true, nil
+		case ErrNotFound:
+			return false, nil
+		case ErrKeyExists:
+			// moved by another request, check again
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (rl *RateLimiter) tokenBucket(key string, n uint64, now time.Time) (RateResult, error) {
+	// tokens refilled since the epoch, and the time at which a position of the
+	// timeline is reached
+	refilled := uint64(float64(now.UnixNano()) / float64(rl.window) * float64(rl.limit))
+	at := func(pos uint64) time.Time {
+		return time.Unix(0, int64(float64(pos)/float64(rl.limit)*float64(rl.window)))
+	}
+
+	// the position is carried over from the previous window's counter when
+	// starting a new one, as the bucket may not be full
+	start := now.Truncate(rl.window)
+	exists, err := rl.catchUp(key, start, refilled)
+	if err != nil {
+		return RateResult{}, err
+	}
+	var pos uint64
+	if exists {
+		pos, _, err = rl.client.Incr(rl.windowKey(key, start), n, 0, 0xffffffff, 0)
+	}
+	if !exists || err == ErrNotFound {
+		var prev uint64
+		prev, _, err = rl.counter(key, start.Add(-rl.window))
+		if err != nil {
+			return RateResult{}, err
+		}
+		if prev < refilled {
+			prev = refilled
+		}
+		pos, err = rl.count(key, start, n, prev+n)
+	}
+	if err != nil {
+		return RateResult{}, err
+	}
+
+	res := RateResult{Allowed: pos <= refilled+rl.limit}
+	if !res.Allowed {
+		rl.uncount(key, start, n)
+		pos -= n
+	}
+	if pos < refilled+rl.limit {
+		res.Remaining = refilled + rl.limit - pos
+	}
+	res.ResetAt = at(pos)
+	if res.ResetAt.Before(now) {
+		res.ResetAt = now
+	}
+	return res, nil
+}
@@ -0,0 +1,124 @@
+package mc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRateLimiter(t *testing.T, algorithm RateAlgorithm, limit uint64) (*RateLimiter, *time.Time) {
+	_, c := newTestClient(nil)
+	rl := NewRateLimiter(c, algorithm, limit, 10*time.Second)
+	now := time.Unix(1500000000, 0)
+	rl.now = func() time.Time { return now }
+	return rl, &now
+}
+
+// allowN counts requests until one is denied, and returns the number allowed.
+func allowN(t *testing.T, rl *RateLimiter, key string) int {
+	for n := 0; n < 100; n++ {
+		res, err := rl.Allow(key)
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		if !res.Allowed {
+			assertEqualf(t, uint64(0), res.Remaining, "denied request should have nothing remaining")
+			return n
+		}
+	}
+	return 100
+}
+
+func TestFixedWindow(t *testing.T) {
+	rl, now := testRateLimiter(t, FixedWindow, 3)
+	start := *now
+
+	for i := uint64(1); i <= 3; i++ {
+		res, err := rl.Allow("foo")
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		assertTruef(t, res.Allowed, "request %d should be allowed", i)
+		assertEqualf(t, 3-i, res.Remaining, "wrong remaining: %v", res.Remaining)
+		assertEqualf(t, start.Add(10*time.Second), res.ResetAt, "wrong reset: %v", res.ResetAt)
+	}
+	res, _ := rl.Allow("foo")
+	assertTruef(t, !res.Allowed, "request above limit should be denied")
+	assertEqualf(t, 0, allowN(t, rl, "foo"), "requests above limit should be denied")
+	assertEqualf(t, 3, allowN(t, rl, "bar"), "keys should be limited separately")
+
+	*now = now.Add(10 * time.Second)
+	assertEqualf(t, 3, allowN(t, rl, "foo"), "limit should reset with the window")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	rl, now := testRateLimiter(t, SlidingWindow, 10)
+	assertEqualf(t, 10, allowN(t, rl, "foo"), "wrong number of requests allowed")
+
+	// half of the previous window overlaps
+	*now = now.Add(15 * time.Second)
+	assertEqualf(t, 5, allowN(t, rl, "foo"), "previous window should be weighted")
+
+	*now = now.Add(20 * time.Second)
+	assertEqualf(t, 10, allowN(t, rl, "foo"), "limit should reset")
+}
+
+func TestTokenBucket(t *testing.T) {
+	rl, now := testRateLimiter(t, TokenBucket, 5)
+	assertEqualf(t, 5, allowN(t, rl, "foo"), "full bucket should allow a burst")
+
+	// a token every 2 seconds
+	*now = now.Add(2 * time.Second)
+	assertEqualf(t, 1, allowN(t, rl, "foo"), "bucket should refill gradually")
+
+	// the bucket is carried over to the next window
+	*now = now.Add(6 * time.Second)
+	assertEqualf(t, 3, allowN(t, rl, "foo"), "wrong number of refilled tokens")
+	*now = now.Add(2 * time.Second)
+	assertEqualf(t, 1, allowN(t, rl, "foo"), "bucket should be carried over")
+
+	// tokens don't accumulate above the bucket size
+	*now = now.Add(100 * time.Second)
+	res, err := rl.AllowN("foo", 2)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertTruef(t, res.Allowed, "request should be allowed")
+	assertEqualf(t, uint64(3), res.Remaining, "wrong remaining: %v", res.Remaining)
+	assertEqualf(t, now.Add(4*time.Second), res.ResetAt, "wrong reset: %v", res.ResetAt)
+	assertEqualf(t, 3, allowN(t, rl, "foo"), "bucket should be capped")
+}
+
+func TestTokenBucketConcurrent(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 16
+	fc, c := newTestClient(config)
+	rl := NewRateLimiter(c, TokenBucket, 100, 10*time.Second)
+	now := time.Unix(1500000000, 0)
+	rl.now = func() time.Time { return now }
+
+	// the bucket lags behind the timeline once full for a while
+	_, err := rl.Allow("foo")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	now = now.Add(5 * time.Second)
+
+	fc.server("a").setDelay(time.Millisecond)
+	type result struct {
+		allowed bool
+		err     error
+	}
+	results := make(chan result, 150)
+	var wg sync.WaitGroup
+	for i := 0; i < 150; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := rl.Allow("foo")
+			results <- result{res.Allowed, err}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	var allowed int
+	for r := range results {
+		assertEqualf(t, nil, r.err, "unexpected error: %v", r.err)
+		if r.allowed {
+			allowed++
+		}
+	}
+	assertEqualf(t, 100, allowed, "a full bucket should allow exactly its size")
+}
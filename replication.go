@@ -0,0 +1,253 @@
+package mc
+
+// Replication.
+//
+// With Config.Replicas set above 1, each key is stored on that many servers:
+// the one chosen by the hasher (the primary) and the next ones in the server
+// list. Set, Add, Replace, Delete and Touch are sent to all of them in
+// parallel, and succeed once Config.WriteQuorum servers succeeded. Writes
+// conditioned on the current value (a CAS, Add or Replace) are first performed
+// on the primary, and only copied to the replicas if they succeeded there: they
+// succeed once applied on the primary, as they can't be undone there if copying
+// them fails (read repair fixes the replicas left behind). Get
+// and GAT read from the primary and fall back to the replicas on a miss or an
+// error. With Config.LocalZone set, reads go to the replicas in the local zone
+// (see the zone option of servers) first, and with Config.HotKeyFanout reads of
+// hot keys start at a random replica.
+//
+// A sample of Get hits (Config.ReadRepairRate) is followed by a background read
+// of the other replicas, and copies missing or differing from the value served
+// are rewritten with it, conditioned on their CAS (or added if missing) so a
+// concurrent write isn't overwritten. Memcached doesn't tell the remaining
+// lifetime of values, so repaired copies expire after Config.ReadRepairTTL.
+//
+// Other operations (e.g. Incr or Append) and streamed values are only sent to
+// the primary. In batches, quiet sets and deletes are copied to the replicas,
+// ignoring their status: neither the quorum nor failover apply.
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// replicated tells whether m is subject to replication.
+func (c *Client) replicated(m *msg) bool {
+	if c.config.Replicas < 2 || m.streaming() {
+		return false
+	}
+	switch m.Op {
+	case opGet, opGAT, opSet, opAdd, opReplace, opDelete, opTouch:
+		return true
+	}
+	return false
+}
+
+// getServers returns the alive servers holding key, the primary first.
+func (c *Client) getServers(key string, n int) ([]*server, error) {
+	if n == 1 {
+		s, err := c.getServer(key)
+		if err != nil {
+			return nil, err
+		}
+		return []*server{s}, nil
+	}
+	idx, err := c.config.Hasher.getServerIndex(c.hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	nServers := uint(len(c.servers))
+	var servers []*server
+	for i := uint(0); i < nServers && len(servers) < n; i++ {
+		s := c.servers[(idx+i)%nServers]
+		if s.isAlive {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, &Error{StatusNetworkError, "All server currently dead", nil}
+	}
+	return servers, nil
+}
+
+// preferLocal orders servers with the ones in the local zone first, keeping
+// their order otherwise.
+func (c *Client) preferLocal(servers []*server) []*server {
+	if c.config.LocalZone == "" {
+		return servers
+	}
+	ordered := make([]*server, 0, len(servers))
+	for _, s := range servers {
+		if s.zone == c.config.LocalZone {
+			ordered = append(ordered, s)
+		}
+	}
+	for _, s := range servers {
+		if s.zone != c.config.LocalZone {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered
+}
+
+// markDown marks s as dead if err is a network error and failover is enabled.
+func (c *Client) markDown(s *server, err error) {
+	if err != nil && err.(*Error).Status == StatusNetworkError && c.config.Failover {
+		if s.changeAlive(false) {
+			go c.wakeUp(s)
+		}
+	}
+}
+
+// performReplicated performs m on the servers holding its key.
+func (c *Client) performReplicated(m *msg) error {
+	servers, err := c.getServers(m.key, c.config.Replicas)
+	if err != nil {
+		return err
+	}
+	if m.Op == opGet || m.Op == opGAT {
+		if c.config.HotKeyFanout && c.hot.isHot(m.key) {
+			servers = spread(servers)
+		}
+		return c.readReplicas(c.preferLocal(servers), m)
+	}
+	return c.writeReplicas(servers, m)
+}
+
+// readReplicas reads m from the first of servers that has it. ErrNotFound is
+// returned if none has it and at least one reported a miss.
+func (c *Client) readReplicas(servers []*server, m *msg) error {
+	// each server gets the request, as a response overwrites it (e.g. the key
+	// of a response isn't the one requested)
+	req := *m
+	var firstErr error
+	notFound := false
+	for i, s := range servers {
+		*m = req
+		err := s.perform(m)
+		if err == nil {
+			if m.Op == opGet && len(m.oextras) == 1 && c.config.ReadRepairRate > 0 &&
+				rand.Float64() < c.config.ReadRepairRate {
+				go c.readRepair(servers, i, req.key, m.val, *m.oextras[0].(*uint32))
+			}
+			return nil
+		}
+		c.markDown(s, err)
+		if err == ErrNotFound {
+			notFound = true
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if notFound {
+		return ErrNotFound
+	}
+	return firstErr
+}
+
+// writeReplicas performs m on servers, and stores the result of the primary in
+// m.
+func (c *Client) writeReplicas(servers []*server, m *msg) error {
+	quorum := c.config.WriteQuorum
+	if quorum <= 0 || quorum > len(servers) {
+		quorum = len(servers)
+	}
+
+	// copy the request to the replicas before it's overwritten by the
+	// response
+	replica := *m
+	ms := []*msg{m}
+	conditional := m.CAS != 0 || m.Op == opAdd || m.Op == opReplace
+	if conditional {
+		replica.CAS = 0
+		if m.Op != opDelete {
+			replica.Op = opSet
+		}
+		err := servers[0].perform(m)
+		c.markDown(servers[0], err)
+		if err != nil {
+			return err
+		}
+		ms, servers = nil, servers[1:]
+		quorum--
+	}
+	for range servers[len(ms):] {
+		r := replica
+		ms = append(ms, &r)
+	}
+
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s *server) {
+			defer wg.Done()
+			errs[i] = s.perform(ms[i])
+			c.markDown(s, errs[i])
+		}(i, s)
+	}
+	wg.Wait()
+
+	// a key missing from some servers is deleted or touched on the others
+	var ok, notFound int
+	var firstErr error
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case err == ErrNotFound && (m.Op == opDelete || m.Op == opTouch):
+			notFound++
+		case firstErr == nil:
+			firstErr = err
+		}
+	}
+	switch {
+	case conditional:
+		// applied on the primary
+		return nil
+	case ok+notFound < quorum:
+		return firstErr
+	case ok == 0:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// readRepair rewrites the copies of key on servers which are missing or differ
+// from the value val with flags read from servers[from].
+func (c *Client) readRepair(servers []*server, from int, key, val string, flags uint32) {
+	for i, s := range servers {
+		if i == from {
+			continue
+		}
+		var rflags uint32
+		m := &msg{
+			header: header{
+				Op: opGet,
+			},
+			oextras: []interface{}{&rflags},
+			key:     key,
+		}
+		err := s.perform(m)
+		repair := &msg{
+			header: header{
+				Op:  opSet,
+				CAS: m.CAS,
+			},
+			iextras: []interface{}{flags, c.config.ReadRepairTTL},
+			key:     key,
+			val:     val,
+		}
+		switch {
+		case err == ErrNotFound:
+			repair.Op, repair.CAS = opAdd, 0
+		case err != nil:
+			continue
+		case m.val == val && rflags == flags:
+			continue
+		}
+		if s.perform(repair) == nil {
+			atomic.AddUint64(&c.metrics.readRepairs, 1)
+		}
+	}
+}
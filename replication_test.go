@@ -0,0 +1,199 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReplicas returns the fake servers holding key, the primary first, and
+// the remaining one.
+func testReplicas(t *testing.T, fc *fakeCluster, c *Client, key string) ([]*fakeServer, *fakeServer) {
+	servers, err := c.getServers(key, len(c.servers))
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	var fs []*fakeServer
+	for _, s := range servers {
+		fs = append(fs, fc.server(s.address))
+	}
+	return fs[:c.config.Replicas], fs[len(fs)-1]
+}
+
+func TestReplication(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Replicas = 2
+	c := fc.client("a b c", config)
+	replicas, other := testReplicas(t, fc, c, "foo")
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	for i, s := range replicas {
+		it, ok := s.get("foo")
+		assertTruef(t, ok && it.val == "bar", "replica %d should have the value", i)
+	}
+	_, ok := other.get("foo")
+	assertTruef(t, !ok, "value shouldn't be stored on other servers")
+
+	// reads fall back to the replicas
+	replicas[0].delete("foo")
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "replica should serve the value: %v", v)
+
+	// CAS writes go to the primary first, then to the replicas
+	c.Set("foo", "bar", 0, 0, 0)
+	_, _, cas, _ := c.Get("foo")
+	_, err = c.Set("foo", "baz", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	it, _ := replicas[1].get("foo")
+	assertEqualf(t, "baz", it.val, "CAS write should be copied to replicas: %v", it.val)
+	_, err = c.Set("foo", "qux", 0, 0, cas)
+	assertEqualf(t, ErrKeyExists, err, "CAS mismatch on primary should fail: %v", err)
+	it, _ = replicas[1].get("foo")
+	assertEqualf(t, "baz", it.val, "failed CAS write shouldn't be copied: %v", it.val)
+
+	_, err = c.Add("foo", "x", 0, 0)
+	assertEqualf(t, ErrKeyExists, err, "add of existing key should fail: %v", err)
+
+	// deletes remove all copies, even if some are already gone
+	replicas[0].delete("foo")
+	err = c.Del("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, ok = replicas[1].get("foo")
+	assertTruef(t, !ok, "replicas should be deleted")
+	assertEqualf(t, ErrNotFound, c.Del("foo"), "delete of missing key should fail")
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrNotFound, err, "expected miss: %v", err)
+
+	// chunks are replicated as well
+	c.config.ChunkSize = 16
+	big := strings.Repeat("x", 100)
+	_, err = c.Set("big", big, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	replicas, _ = testReplicas(t, fc, c, "big")
+	for _, key := range replicas[0].keys() {
+		replicas[0].delete(key)
+	}
+	v, _, _, err = c.Get("big")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, v == big, "replica should serve chunked value")
+}
+
+func TestReplicationQuorum(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Replicas = 2
+	config.Failover = false
+	config.Retries = 1
+	c := fc.client("a b c", config)
+	replicas, _ := testReplicas(t, fc, c, "foo")
+
+	replicas[1].setDown(true)
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertNotEqualf(t, mcNil, err, "write should fail without quorum")
+
+	c.config.WriteQuorum = 1
+	_, err = c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "write should succeed with quorum: %v", err)
+
+	replicas[1].setDown(false)
+	replicas[0].setDown(true)
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, ErrNotFound, err, "replica missed the write: %v", err)
+	replicas[0].setDown(false)
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+
+	// conditional writes applied on the primary succeed, even without quorum
+	c.config.WriteQuorum = 0
+	replicas[1].setDown(true)
+	_, _, cas, _ := c.Get("foo")
+	_, err = c.Set("foo", "baz", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "CAS write applied on the primary should succeed: %v", err)
+	_, err = c.Add("new", "x", 0, 0)
+	assertEqualf(t, mcNil, err, "add applied on the primary should succeed: %v", err)
+}
+
+func TestReadRepair(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Replicas = 3
+	config.ReadRepairRate = 1
+	c := fc.client("a b c", config)
+	replicas, _ := testReplicas(t, fc, c, "foo")
+
+	_, err := c.Set("foo", "bar", 42, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	replicas[1].delete("foo")
+	srv := replicas[2]
+	srv.lock.Lock()
+	srv.store("foo", "stale", 42, 0)
+	srv.lock.Unlock()
+
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value: %v", v)
+	for i := 0; i < 100 && c.Metrics().ReadRepairs < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assertEqualf(t, uint64(2), c.Metrics().ReadRepairs, "wrong number of repairs: %+v", c.Metrics())
+	for i, s := range replicas {
+		it, ok := s.get("foo")
+		assertTruef(t, ok && it.val == "bar" && it.flags == 42, "replica %d should be repaired", i)
+	}
+
+	// reads are only sampled at the configured rate
+	c.config.ReadRepairRate = 0
+	c.Get("foo")
+	assertEqualf(t, uint64(2), c.Metrics().ReadRepairs, "reads shouldn't be sampled")
+}
+
+func TestReadRepairFallback(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Replicas = 2
+	config.ReadRepairRate = 1
+	c := fc.client("a b", config)
+	replicas, _ := testReplicas(t, fc, c, "foo")
+
+	// the primary misses the value, which is served and repaired by the replica
+	replicas[1].set("foo", "bar", 0)
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "replica should serve the value: %v", v)
+	for i := 0; i < 100 && c.Metrics().ReadRepairs < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	it, ok := replicas[0].get("foo")
+	assertTruef(t, ok && it.val == "bar", "primary should be repaired")
+	for i, s := range replicas {
+		_, ok := s.get("")
+		assertTruef(t, !ok, "replica %d shouldn't have an empty key", i)
+	}
+}
+
+func TestReplicationZones(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Replicas = 2
+	config.LocalZone = "z2"
+	c := fc.client("a?zone=z1 b?zone=z2", config)
+	assertEqualf(t, "z1", c.servers[0].zone, "wrong zone: %v", c.servers[0].zone)
+
+	fc.server("a").set("foo", "a", 0)
+	fc.server("b").set("foo", "b", 0)
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "b", v, "read should go to the local zone: %v", v)
+
+	c.config.LocalZone = "z1"
+	v, _, _, _ = c.Get("foo")
+	assertEqualf(t, "a", v, "read should go to the local zone: %v", v)
+
+	// other replicas are still used as a fallback
+	fc.server("a").delete("foo")
+	v, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "b", v, "remote replica should serve the value: %v", v)
+}
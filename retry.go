@@ -0,0 +1,168 @@
+package mc
+
+// Retries.
+//
+// Requests failing with a network error are retried on the same server as
+// decided by Config.RetryPolicy, before failing over to another server (see
+// Config.Failover, which only applies to idempotent operations). Operations
+// that can't safely be applied twice (Incr, Decr, Append and Prepend) aren't
+// idempotent: a request may fail after the server applied it, so retrying
+// them can apply them twice. The default policy
+// (Config.RetryPolicy left nil) tries idempotent operations Config.Retries
+// times, waiting Config.RetryDelay between attempts, and never retries the
+// others. Custom policies decide for every operation. Streamed requests and
+// batches are never retried.
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides whether a request failing with a network error is
+// retried. It must be safe for concurrent use.
+type RetryPolicy interface {
+	// Retry is called when the attempt-th attempt (starting at 1) of the
+	// operation op (e.g. "get" or "incr") failed with err. idempotent tells
+	// whether op can safely be applied twice. It returns whether to retry,
+	// and how long to wait before.
+	Retry(op string, idempotent bool, attempt int, err error) (time.Duration, bool)
+}
+
+// opNames are the names of operations given to RetryPolicy.
+var opNames = map[opCode]string{
+	opGet:       "get",
+	opSet:       "set",
+	opAdd:       "add",
+	opReplace:   "replace",
+	opDelete:    "delete",
+	opIncrement: "incr",
+	opDecrement: "decr",
+	opQuit:      "quit",
+	opFlush:     "flush",
+	opNoop:      "noop",
+	opVersion:   "version",
+	opAppend:    "append",
+	opPrepend:   "prepend",
+	opStat:      "stat",
+	opTouch:     "touch",
+	opGAT:       "gat",
+	opAuthList:  "sasl_list",
+	opAuthStart: "sasl_start",
+	opAuthStep:  "sasl_step",
+}
+
+func opName(op opCode) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op_%#02x", uint8(op))
+}
+
+// idempotent returns whether applying op twice has the same effect as applying
+// it once.
+func idempotent(op opCode) bool {
+	switch op {
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ,
+		opAppend, opAppendQ, opPrepend, opPrependQ:
+		return false
+	}
+	return true
+}
+
+// fixedRetry is the default policy: idempotent operations are tried attempts
+// times, waiting delay between attempts.
+type fixedRetry struct {
+	attempts int
+	delay    time.Duration
+}
+
+func (r fixedRetry) Retry(op string, idempotent bool, attempt int, err error) (time.Duration, bool) {
+	return r.delay, idempotent && attempt < r.attempts
+}
+
+// retryPolicy returns the retry policy of config.
+func retryPolicy(config *Config) RetryPolicy {
+	if config.RetryPolicy != nil {
+		return config.RetryPolicy
+	}
+	return fixedRetry{config.Retries, config.RetryDelay}
+}
+
+// ExponentialBackoff is a RetryPolicy retrying idempotent operations with
+// exponentially growing delays.
+type ExponentialBackoff struct {
+	// MaxAttempts is the number of times a request is tried, including the
+	// first attempt.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled on each retry up
+	// to MaxDelay (if set).
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction of each delay that is randomized (between 0 and
+	// 1), so clients don't retry in lockstep.
+	Jitter float64
+	// Retryable overrides whether operations are retried, by name, e.g.
+	// {"incr": true} to retry Incr despite the risk of applying it twice, or
+	// {"delete": false} not to retry Del.
+	Retryable map[string]bool
+	// Budget caps the retries to Budget per second across all requests (with
+	// bursts of up to Budget, or 1), so a failing server isn't flooded with
+	// retries. 0 doesn't cap them.
+	Budget float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Retry implements RetryPolicy.
+func (b *ExponentialBackoff) Retry(op string, idempotent bool, attempt int, err error) (time.Duration, bool) {
+	if retryable, ok := b.Retryable[op]; ok {
+		idempotent = retryable
+	}
+	if !idempotent || attempt >= b.MaxAttempts || !b.spend() {
+		return 0, false
+	}
+
+	delay := b.BaseDelay
+	for i := 1; i < attempt && (b.MaxDelay == 0 || delay < b.MaxDelay); i++ {
+		delay *= 2
+	}
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+	if b.Jitter > 0 {
+		delay -= time.Duration(b.Jitter * rand.Float64() * float64(delay))
+	}
+	return delay, true
+}
+
+// spend takes a retry from the budget, if any is left.
+func (b *ExponentialBackoff) spend() bool {
+	if b.Budget <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	burst := b.Budget
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.Budget
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
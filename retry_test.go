@@ -0,0 +1,98 @@
+package mc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryIdempotency(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 3
+	config.RetryDelay = time.Millisecond
+	config.Failover = false
+	c := newMockableMC("s1-3", "", "", config, newMockConn)
+
+	// the first attempt fails, and appends aren't retried
+	_, err := c.Append("k1", "x", 0)
+	assertNotEqualf(t, mcNil, err, "append shouldn't be retried")
+	_, _, err = c.Incr("k1", 1, 0, 0, 0)
+	assertNotEqualf(t, mcNil, err, "incr shouldn't be retried")
+
+	// the third attempt succeeds
+	_, _, _, err = c.Get("k1")
+	assertEqualf(t, mcNil, err, "get should be retried: %v", err)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.Failover = false
+	config.RetryPolicy = &ExponentialBackoff{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		Retryable:   map[string]bool{"append": true, "get": false},
+	}
+	c := newMockableMC("s1-3", "", "", config, newMockConn)
+
+	_, err := c.Append("k1", "x", 0)
+	assertEqualf(t, mcNil, err, "append should be retried: %v", err)
+	_, _, _, err = c.Get("k1")
+	assertNotEqualf(t, mcNil, err, "get shouldn't be retried")
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{
+		MaxAttempts: 5,
+		BaseDelay:   10 * time.Millisecond,
+		MaxDelay:    50 * time.Millisecond,
+	}
+	for i, expected := range []time.Duration{10, 20, 40, 50} {
+		delay, ok := b.Retry("get", true, i+1, ErrUnknownError)
+		assertTruef(t, ok, "attempt %d should be retried", i+1)
+		assertEqualf(t, expected*time.Millisecond, delay, "wrong delay for attempt %d: %v", i+1, delay)
+	}
+	_, ok := b.Retry("get", true, 5, ErrUnknownError)
+	assertTruef(t, !ok, "last attempt shouldn't be retried")
+	_, ok = b.Retry("incr", false, 1, ErrUnknownError)
+	assertTruef(t, !ok, "non-idempotent operation shouldn't be retried")
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay, _ := b.Retry("get", true, 2, ErrUnknownError)
+		assertTruef(t, delay >= 10*time.Millisecond && delay <= 20*time.Millisecond, "wrong jittered delay: %v", delay)
+	}
+
+	b = &ExponentialBackoff{MaxAttempts: 5, Budget: 2}
+	for i := 0; i < 2; i++ {
+		_, ok = b.Retry("get", true, 1, ErrUnknownError)
+		assertTruef(t, ok, "retry %d should be within budget", i)
+	}
+	_, ok = b.Retry("get", true, 1, ErrUnknownError)
+	assertTruef(t, !ok, "retry should exceed budget")
+}
+
+func TestFailoverIdempotency(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.Retries = 1
+	c := fc.client("a,b", config)
+
+	s, err := c.getServer("k1")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	down, other := fc.server(s.address), fc.server("b")
+	if down == other {
+		other = fc.server("a")
+	}
+	down.setDown(true)
+
+	// the failed server may have applied the increment, so it isn't sent to
+	// another server
+	_, _, err = c.Incr("k1", 1, 0, 0, 0)
+	assertNotEqualf(t, mcNil, err, "incr shouldn't fail over")
+	_, ok := other.get("k1")
+	assertTruef(t, !ok, "incr shouldn't reach another server")
+
+	_, err = c.Set("k1", "v", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "set should fail over: %v", err)
+	_, ok = other.get("k1")
+	assertTruef(t, ok, "set should reach another server")
+}
@@ -0,0 +1,280 @@
+package mc
+
+// Routing of keys to pools.
+//
+// A Router serves keys from several pools of servers, each a Client with its
+// own configuration, choosing the pool of each key with routes matching key
+// prefixes or regular expressions. Routes are tried in the order they were
+// added, keys matching none go to the default pool.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type route struct {
+	prefix string
+	re     *regexp.Regexp
+	pool   *Client
+}
+
+func (rt *route) match(key string) bool {
+	if rt.re != nil {
+		return rt.re.MatchString(key)
+	}
+	return strings.HasPrefix(key, rt.prefix)
+}
+
+// Router routes keys to pools of servers. It is safe for concurrent use.
+type Router struct {
+	lock   sync.RWMutex
+	pools  map[string]*Client
+	routes []route
+	def    *Client
+}
+
+var _ Cache = (*Router)(nil)
+
+// NewRouter creates a router without pools.
+func NewRouter() *Router {
+	return &Router{pools: make(map[string]*Client)}
+}
+
+// AddPool adds the pool name served by c.
+func (r *Router) AddPool(name string, c *Client) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.pools[name]; ok {
+		return fmt.Errorf("mc: pool %q already exists", name)
+	}
+	r.pools[name] = c
+	return nil
+}
+
+// Pool returns the client of pool name.
+func (r *Router) Pool(name string) (*Client, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c, ok := r.pools[name]
+	return c, ok
+}
+
+// RoutePrefix routes the keys starting with prefix to pool.
+func (r *Router) RoutePrefix(prefix, pool string) error {
+	return r.addRoute(route{prefix: prefix}, pool)
+}
+
+// RouteRegexp routes the keys matching the regular expression expr to pool.
+func (r *Router) RouteRegexp(expr, pool string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	return r.addRoute(route{re: re}, pool)
+}
+
+// SetDefault routes the keys matching no route to pool.
+func (r *Router) SetDefault(pool string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c, ok := r.pools[pool]
+	if !ok {
+		return fmt.Errorf("mc: unknown pool %q", pool)
+	}
+	r.def = c
+	return nil
+}
+
+func (r *Router) addRoute(rt route, pool string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c, ok := r.pools[pool]
+	if !ok {
+		return fmt.Errorf("mc: unknown pool %q", pool)
+	}
+	rt.pool = c
+	r.routes = append(r.routes, rt)
+	return nil
+}
+
+// Route returns the client of the pool key is routed to.
+func (r *Router) Route(key string) (*Client, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for i := range r.routes {
+		if r.routes[i].match(key) {
+			return r.routes[i].pool, nil
+		}
+	}
+	if r.def == nil {
+		return nil, ErrNoRoute
+	}
+	return r.def, nil
+}
+
+// clients returns the clients of all pools.
+func (r *Router) clients() []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	clients := make([]*Client, 0, len(r.pools))
+	for _, c := range r.pools {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Get retrieves a value from the pool of key. See Client.Get.
+func (r *Router) Get(key string) (val string, flags uint32, cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return c.Get(key)
+}
+
+// GAT retrieves a value from the pool of key and updates its expiration time.
+// See Client.GAT.
+func (r *Router) GAT(key string, exp uint32) (val string, flags uint32, cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return c.GAT(key, exp)
+}
+
+// GetObject retrieves a value from the pool of key. See Client.GetObject.
+func (r *Router) GetObject(key string, v interface{}) (flags uint32, cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.GetObject(key, v)
+}
+
+// Touch updates the expiration time of a key in its pool. See Client.Touch.
+func (r *Router) Touch(key string, exp uint32) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Touch(key, exp)
+}
+
+// Set sets a key/value pair in the pool of key. See Client.Set.
+func (r *Router) Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Set(key, val, flags, exp, ocas)
+}
+
+// Replace replaces a key/value pair in the pool of key. See Client.Replace.
+func (r *Router) Replace(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Replace(key, val, flags, exp, ocas)
+}
+
+// Add adds a key/value pair to the pool of key. See Client.Add.
+func (r *Router) Add(key, val string, flags, exp uint32) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Add(key, val, flags, exp)
+}
+
+// SetObject sets a value in the pool of key. See Client.SetObject.
+func (r *Router) SetObject(key string, v interface{}, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.SetObject(key, v, flags, exp, ocas)
+}
+
+// Incr increments a value in the pool of key. See Client.Incr.
+func (r *Router) Incr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.Incr(key, delta, init, exp, ocas)
+}
+
+// Decr decrements a value in the pool of key. See Client.Decr.
+func (r *Router) Decr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.Decr(key, delta, init, exp, ocas)
+}
+
+// Append appends to a value in the pool of key. See Client.Append.
+func (r *Router) Append(key, val string, ocas uint64) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Append(key, val, ocas)
+}
+
+// Prepend prepends to a value in the pool of key. See Client.Prepend.
+func (r *Router) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Prepend(key, val, ocas)
+}
+
+// Del deletes a key from its pool. See Client.Del.
+func (r *Router) Del(key string) (err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return err
+	}
+	return c.Del(key)
+}
+
+// DelCAS deletes a key from its pool if its CAS matches. See Client.DelCAS.
+func (r *Router) DelCAS(key string, cas uint64) (err error) {
+	c, err := r.Route(key)
+	if err != nil {
+		return err
+	}
+	return c.DelCAS(key, cas)
+}
+
+// Flush flushes all pools. See Client.Flush.
+func (r *Router) Flush(when uint32) (err error) {
+	for _, c := range r.clients() {
+		if cErr := c.Flush(when); cErr != nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// NoOp sends a No-Op message to all pools. See Client.NoOp.
+func (r *Router) NoOp() (err error) {
+	for _, c := range r.clients() {
+		if cErr := c.NoOp(); cErr != nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// Quit closes the connections to all pools. See Client.Quit.
+func (r *Router) Quit() {
+	for _, c := range r.clients() {
+		c.Quit()
+	}
+}
@@ -0,0 +1,48 @@
+package mc
+
+import (
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	fc := newFakeCluster()
+	r := NewRouter()
+	for _, pool := range []string{"sessions", "counters", "main"} {
+		assertEqualf(t, nil, r.AddPool(pool, fc.client(pool, DefaultConfig())), "unexpected error")
+	}
+	assertNotEqualf(t, nil, r.AddPool("main", fc.client("x", DefaultConfig())), "duplicate pool should fail")
+	assertNotEqualf(t, nil, r.RoutePrefix("x:", "unknown"), "unknown pool should fail")
+	assertNotEqualf(t, nil, r.RouteRegexp("(", "main"), "invalid regexp should fail")
+
+	_, err := r.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, ErrNoRoute, err, "key without route should fail: %v", err)
+
+	assertEqualf(t, nil, r.RoutePrefix("session:", "sessions"), "unexpected error")
+	assertEqualf(t, nil, r.RouteRegexp(`^rl:.*:\d+$`, "counters"), "unexpected error")
+	assertEqualf(t, nil, r.SetDefault("main"), "unexpected error")
+
+	keys := map[string]string{
+		"session:42":   "sessions",
+		"rl:user:1500": "counters",
+		"rl:user":      "main",
+		"foo":          "main",
+	}
+	for key, pool := range keys {
+		_, err := r.Set(key, "v", 0, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		_, ok := fc.server(pool).get(key)
+		assertTruef(t, ok, "%s should be routed to %s", key, pool)
+		v, _, _, err := r.Get(key)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, "v", v, "wrong value: %v", v)
+	}
+
+	n, _, err := r.Incr("rl:user:1600", 1, 1, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(1), n, "wrong counter: %v", n)
+
+	assertEqualf(t, mcNil, r.Flush(0), "unexpected error")
+	for _, pool := range []string{"sessions", "counters", "main"} {
+		assertEqualf(t, 0, len(fc.server(pool).keys()), "%s should be flushed", pool)
+	}
+}
@@ -3,8 +3,10 @@ package mc
 // Handles all server connections to a particular memcached servers.
 
 import (
+	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,15 +22,83 @@ type server struct {
 	pool    chan mcConn
 	isAlive bool
 	lock    sync.Mutex
+	// gutter servers limit the expiration of values, see gutter.go
+	gutter bool
+	// weight is the share of keys of the server relative to the others
+	weight int
+	// zone is the availability zone of the server, if known
+	zone string
 }
 
 const defaultPort = "11211"
 
+// maxWeight is the largest weight of a server, as the modulo hasher holds a
+// slot per unit of weight.
+const maxWeight = 100
+
+// parseServerOptions splits the options of a server from its address. Options
+// are given as a query string (e.g. "host:11211?weight=4&zone=eu-west-1a"), or
+// for the weight as a third field (e.g. "host:11211:4?zone=eu-west-1a"), the
+// query taking precedence.
+func parseServerOptions(address string) (string, url.Values) {
+	options := url.Values{}
+	if i := strings.IndexByte(address, '?'); i >= 0 {
+		options, _ = url.ParseQuery(address[i+1:])
+		address = address[:i]
+	}
+
+	// IPv6 addresses are enclosed in brackets when followed by a port, so
+	// bare ones (e.g. "::1" or "fe80::1") never have a valid port as their
+	// second field
+	if !strings.Contains(address, "://") {
+		hostPort := address[strings.LastIndexByte(address, ']')+1:]
+		if fields := strings.Split(hostPort, ":"); len(fields) == 3 && validPort(fields[1]) {
+			i := strings.LastIndexByte(address, ':')
+			if options.Get("weight") == "" {
+				options.Set("weight", address[i+1:])
+			}
+			address = address[:i]
+		}
+	}
+	return address, options
+}
+
+// parseWeight parses the weight option of the server at address. Invalid
+// weights are logged and replaced by 1, and weights above maxWeight are logged
+// and clamped.
+func parseWeight(address, option string) int {
+	if option == "" {
+		return 1
+	}
+	weight, err := strconv.Atoi(option)
+	switch {
+	case err != nil || weight < 1:
+		log.Printf("mc: invalid weight %q of server %s, using 1", option, address)
+		return 1
+	case weight > maxWeight:
+		log.Printf("mc: weight %d of server %s above %d, using %d", weight, address, maxWeight, maxWeight)
+		return maxWeight
+	}
+	return weight
+}
+
+// validPort returns whether port is a port number.
+func validPort(port string) bool {
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n > 0
+}
+
 func newServer(address, username, password string, config *Config, newMcConn connGen) *server {
+	address, options := parseServerOptions(address)
+	weight := parseWeight(address, options.Get("weight"))
+
 	addr := address
 	scheme := "tcp"
 
-	if u, err := url.Parse(address); err == nil {
+	if net.ParseIP(address) != nil {
+		// bare IPv6 addresses don't parse as URLs
+		addr = net.JoinHostPort(address, defaultPort)
+	} else if u, err := url.Parse(address); err == nil {
 		switch strings.ToLower(u.Scheme) {
 		case "tcp":
 			if len(u.Port()) == 0 {
@@ -56,6 +126,8 @@ func newServer(address, username, password string, config *Config, newMcConn con
 		config:  config,
 		pool:    make(chan mcConn, config.PoolSize),
 		isAlive: true,
+		weight:  weight,
+		zone:    options.Get("zone"),
 	}
 
 	for i := 0; i < config.PoolSize; i++ {
@@ -66,8 +138,11 @@ func newServer(address, username, password string, config *Config, newMcConn con
 }
 
 func (s *server) perform(m *msg) error {
-	var err error
-	for i := 0; ; {
+	if s.gutter {
+		s.clampExp(m)
+	}
+	policy := retryPolicy(s.config)
+	for attempt := 1; ; attempt++ {
 		timeout := time.After(s.config.ConnectionTimeout)
 		select {
 		case c := <-s.pool:
@@ -76,12 +151,16 @@ func (s *server) perform(m *msg) error {
 				return &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
 			}
 
-			// backup request if a retry might be possible
-			if i+1 < s.config.Retries {
-				c.backup(m)
+			// backup request if a retry might be possible, locally as the
+			// connection goes back to the pool before the retry (the
+			// connection only overwrites the header, key and value of m)
+			var backup msg
+			retryable := !m.streaming()
+			if retryable {
+				backup = *m
 			}
 
-			err = c.perform(m)
+			err := c.perform(m)
 			s.pool <- c
 			if err == nil {
 				return nil
@@ -93,14 +172,16 @@ func (s *server) perform(m *msg) error {
 			}
 
 			// check if retry needed
-			i++
-			if i < s.config.Retries {
-				// restore request since m now contains the failed response
-				c.restore(m)
-				time.Sleep(s.config.RetryDelay)
-			} else {
+			if !retryable {
+				return err
+			}
+			delay, retry := policy.Retry(opName(m.Op), idempotent(m.Op), attempt, err)
+			if !retry {
 				return err
 			}
+			// restore request since m now contains the failed response
+			*m = backup
+			time.Sleep(delay)
 		case <-timeout:
 			// do not retry
 			return &Error{StatusUnknownError,
@@ -134,6 +215,35 @@ func (s *server) performStats(m *msg) (McStats, error) {
 	}
 }
 
+// performBatch sends several requests at once over a single connection. Batches
+// aren't retried.
+func (s *server) performBatch(ms []*msg) error {
+	if s.gutter {
+		for _, m := range ms {
+			s.clampExp(m)
+		}
+	}
+	timeout := time.After(s.config.ConnectionTimeout)
+	select {
+	case c := <-s.pool:
+		// NOTE: this serverConn is no longer available in the pool (equivalent to locking)
+		if c == nil {
+			return &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
+		}
+
+		err := c.performBatch(ms)
+		s.pool <- c
+		return err
+
+	case <-timeout:
+		// do not retry
+		return &Error{StatusUnknownError,
+			"Timed out while waiting for connection from pool. " +
+				"Maybe increase your pool size?",
+			nil}
+	}
+}
+
 func (s *server) quit(m *msg) {
 	for i := 0; i < s.config.PoolSize; i++ {
 		c := <-s.pool
@@ -53,25 +53,23 @@ func putBodyBuffer(buf []byte) {
 type mcConn interface {
 	perform(m *msg) error
 	performStats(m *msg) (McStats, error)
+	performBatch(ms []*msg) error
 	quit(m *msg)
-	backup(m *msg)
-	restore(m *msg)
 }
 
 type connGen func(address, scheme, username, password string, config *Config) mcConn
 
 // serverConn is a connection to a memcache server.
 type serverConn struct {
-	address   string
-	scheme    string
-	username  string
-	password  string
-	config    *Config
-	conn      net.Conn
-	rw        *bufio.ReadWriter
-	opq       uint32
-	backupMsg msg
-	hdrBuf    [24]byte // pre-allocated buffer for headers
+	address  string
+	scheme   string
+	username string
+	password string
+	config   *Config
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	opq      uint32
+	hdrBuf   [24]byte // pre-allocated buffer for headers
 }
 
 func newServerConn(address, scheme, username, password string, config *Config) mcConn {
@@ -107,6 +105,17 @@ func (sc *serverConn) performStats(m *msg) (McStats, error) {
 	return sc.sendRecvStats(m)
 }
 
+func (sc *serverConn) performBatch(ms []*msg) error {
+	// lazy connection
+	if sc.conn == nil {
+		err := sc.connect()
+		if err != nil {
+			return err
+		}
+	}
+	return sc.sendRecvBatch(ms)
+}
+
 func (sc *serverConn) quit(m *msg) {
 	if sc.conn != nil {
 		sc.sendRecv(m)
@@ -238,12 +247,92 @@ func (sc *serverConn) sendRecvStats(m *msg) (stats McStats, err error) {
 	}
 }
 
+// sendRecvBatch pipelines several requests: it sends all of them followed by a
+// NOOP and then receives responses until the NOOP's one. Responses are matched
+// to requests through their opaque, as quiet requests may not get any. The
+// status of each request is stored in its ResvOrStatus field, only network
+// errors are returned.
+func (sc *serverConn) sendRecvBatch(ms []*msg) error {
+	noop := &msg{
+		header: header{
+			Op: opNoop,
+		},
+	}
+	base := sc.opq
+	for _, m := range ms {
+		if err := sc.write(m); err != nil {
+			sc.resetConn(err)
+			return err
+		}
+	}
+	if err := sc.send(noop); err != nil {
+		sc.resetConn(err)
+		return err
+	}
+
+	// quiet requests only get a response on a miss for gets and on an error for
+	// everything else
+	for _, m := range ms {
+		switch m.Op {
+		case opGetQ, opGetKQ, opGATQ, opGATKQ:
+			m.ResvOrStatus = StatusNotFound
+		default:
+			m.ResvOrStatus = StatusOK
+		}
+	}
+
+	for {
+		var h header
+		if err := sc.recvHeader(&h); err != nil {
+			sc.resetConn(err)
+			return err
+		}
+
+		target := noop
+		if h.Opaque != noop.Opaque {
+			idx := h.Opaque - base
+			if idx >= uint32(len(ms)) {
+				err := wrapError(StatusNetworkError,
+					fmt.Errorf("mc: unexpected opaque %d in batch response", h.Opaque))
+				sc.resetConn(err)
+				return err
+			}
+			target = ms[idx]
+		}
+		target.header = h
+
+		if err := sc.recvBody(target); err != nil && err.(*Error).Status == StatusNetworkError {
+			sc.resetConn(err)
+			return err
+		}
+		if target == noop {
+			return nil
+		}
+	}
+}
+
 // send sends a request to the memcache server.
 func (sc *serverConn) send(m *msg) error {
+	if err := sc.write(m); err != nil {
+		return err
+	}
+	if err := sc.rw.Flush(); err != nil {
+		return wrapError(StatusNetworkError, err)
+	}
+	return nil
+}
+
+// write writes a request to the connection buffer without flushing it, so
+// that several requests can be sent at once.
+func (sc *serverConn) write(m *msg) error {
 	m.Magic = magicSend
 	m.ExtraLen = sizeOfExtras(m.iextras)
 	m.KeyLen = uint16(len(m.key))
-	m.BodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen) + uint32(len(m.val))
+	if m.valReader != nil {
+		m.BodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen) + uint32(m.valLen)
+	} else {
+		m.BodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen) + uint32(len(m.val))
+	}
 	m.Opaque = sc.opq
 	sc.opq++
 
@@ -296,22 +385,83 @@ func (sc *serverConn) send(m *msg) error {
 		}
 	}
 
-	if len(m.val) > 0 {
+	if m.valReader != nil {
+		if err := sc.sendStream(m); err != nil {
+			return err
+		}
+	} else if len(m.val) > 0 {
 		if _, err := io.WriteString(sc.rw, m.val); err != nil {
 			return wrapError(StatusNetworkError, err)
 		}
 	}
 
-	if err := sc.rw.Flush(); err != nil {
-		return wrapError(StatusNetworkError, err)
+	return nil
+}
+
+// sendStream copies the request value from m.valReader to the connection. If
+// the reader fails the request on the wire is incomplete, so the connection is
+// dropped, but the error isn't reported as a network error as the server is
+// fine.
+func (sc *serverConn) sendStream(m *msg) error {
+	buf := largeBodyPool.Get().([]byte)
+	defer largeBodyPool.Put(buf)
+
+	for remaining := m.valLen; remaining > 0; {
+		chunk := buf
+		if remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, rErr := io.ReadFull(m.valReader, chunk)
+		if _, err := sc.rw.Write(chunk[:n]); err != nil {
+			return wrapError(StatusNetworkError, err)
+		}
+		remaining -= int64(n)
+		if rErr != nil {
+			if rErr == io.EOF {
+				rErr = io.ErrUnexpectedEOF
+			}
+			sc.closeConn()
+			return wrapError(StatusUnknownError, rErr)
+		}
 	}
+	return nil
+}
 
+// recvStream copies n bytes of the response value from the connection to
+// m.valWriter. As with sendStream, a failing writer leaves unread data on the
+// connection, so it is dropped.
+func (sc *serverConn) recvStream(m *msg, n int64) error {
+	buf := largeBodyPool.Get().([]byte)
+	defer largeBodyPool.Put(buf)
+
+	for remaining := n; remaining > 0; {
+		chunk := buf
+		if remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := io.ReadFull(sc.rw, chunk); err != nil {
+			return wrapError(StatusNetworkError, err)
+		}
+		remaining -= int64(len(chunk))
+		if _, err := m.valWriter.Write(chunk); err != nil {
+			sc.closeConn()
+			return wrapError(StatusUnknownError, err)
+		}
+	}
 	return nil
 }
 
 // recv receives a memcached response. It takes a msg into which to store the
 // response.
 func (sc *serverConn) recv(m *msg) error {
+	if err := sc.recvHeader(&m.header); err != nil {
+		return err
+	}
+	return sc.recvBody(m)
+}
+
+// recvHeader receives the header of a memcached response.
+func (sc *serverConn) recvHeader(h *header) error {
 	// Make sure read does not block forever
 	sc.conn.SetReadDeadline(time.Now().Add(sc.config.ConnectionTimeout))
 
@@ -321,20 +471,34 @@ func (sc *serverConn) recv(m *msg) error {
 	}
 
 	// Parse Header
-	m.header.Magic = magicCode(sc.hdrBuf[0])
-	m.header.Op = opCode(sc.hdrBuf[1])
-	m.header.KeyLen = binary.BigEndian.Uint16(sc.hdrBuf[2:])
-	m.header.ExtraLen = sc.hdrBuf[4]
-	m.header.DataType = sc.hdrBuf[5]
-	m.header.ResvOrStatus = binary.BigEndian.Uint16(sc.hdrBuf[6:])
-	m.header.BodyLen = binary.BigEndian.Uint32(sc.hdrBuf[8:])
-	m.header.Opaque = binary.BigEndian.Uint32(sc.hdrBuf[12:])
-	m.header.CAS = binary.BigEndian.Uint64(sc.hdrBuf[16:])
+	h.Magic = magicCode(sc.hdrBuf[0])
+	h.Op = opCode(sc.hdrBuf[1])
+	h.KeyLen = binary.BigEndian.Uint16(sc.hdrBuf[2:])
+	h.ExtraLen = sc.hdrBuf[4]
+	h.DataType = sc.hdrBuf[5]
+	h.ResvOrStatus = binary.BigEndian.Uint16(sc.hdrBuf[6:])
+	h.BodyLen = binary.BigEndian.Uint32(sc.hdrBuf[8:])
+	h.Opaque = binary.BigEndian.Uint32(sc.hdrBuf[12:])
+	h.CAS = binary.BigEndian.Uint64(sc.hdrBuf[16:])
+	return nil
+}
 
+// recvBody receives the body of a memcached response whose header was already
+// received into m.
+func (sc *serverConn) recvBody(m *msg) error {
 	// Read Body
 	// Use pooled buffer for the body. Since we convert to string (which copies),
-	// we can safely return the buffer to the pool after.
-	body := getBodyBuffer(int(m.BodyLen))
+	// we can safely return the buffer to the pool after. A streamed value is not
+	// read into the buffer, only the extras and key preceding it.
+	bodyLen := m.BodyLen
+	stream := m.valWriter != nil && m.ResvOrStatus == 0
+	if stream {
+		bodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen)
+		if bodyLen > m.BodyLen {
+			return wrapError(StatusNetworkError, io.ErrUnexpectedEOF)
+		}
+	}
+	body := getBodyBuffer(int(bodyLen))
 	defer putBodyBuffer(body)
 	if _, err := io.ReadFull(sc.rw, body); err != nil {
 		return wrapError(StatusNetworkError, err)
@@ -394,7 +558,14 @@ func (sc *serverConn) recv(m *msg) error {
 	buf = buf[m.KeyLen:]
 
 	// Read Value (remaining)
-	m.val = string(buf)
+	if stream {
+		m.val = ""
+		if err := sc.recvStream(m, int64(m.BodyLen-bodyLen)); err != nil {
+			return err
+		}
+	} else {
+		m.val = string(buf)
+	}
 
 	return newError(m.ResvOrStatus)
 }
@@ -422,60 +593,15 @@ func sizeOfExtras(extras []interface{}) (l uint8) {
 // reconnect on next usage.
 func (sc *serverConn) resetConn(err error) {
 	if err.(*Error).Status == StatusNetworkError {
-		if sc.conn != nil {
-			sc.conn.Close()
-			sc.conn = nil
-			sc.rw = nil
-		}
+		sc.closeConn()
 	}
 }
 
-func (sc *serverConn) backup(m *msg) {
-	backupMsg(m, &sc.backupMsg)
-}
-
-func backupMsg(m *msg, backupMsg *msg) {
-	backupMsg.key = m.key
-	backupMsg.val = m.val
-	backupMsg.header = m.header // Copy entire struct at once
-
-	// Reuse slice capacity if possible to avoid allocation
-	if cap(backupMsg.iextras) >= len(m.iextras) {
-		backupMsg.iextras = backupMsg.iextras[:len(m.iextras)]
-	} else {
-		backupMsg.iextras = make([]interface{}, len(m.iextras))
-	}
-	copy(backupMsg.iextras, m.iextras)
-
-	if cap(backupMsg.oextras) >= len(m.oextras) {
-		backupMsg.oextras = backupMsg.oextras[:len(m.oextras)]
-	} else {
-		backupMsg.oextras = make([]interface{}, len(m.oextras))
-	}
-	copy(backupMsg.oextras, m.oextras)
-}
-
-func (sc *serverConn) restore(m *msg) {
-	restoreMsg(m, &sc.backupMsg)
-}
-
-func restoreMsg(m *msg, backupMsg *msg) {
-	m.key = backupMsg.key
-	m.val = backupMsg.val
-	m.header = backupMsg.header // Copy entire struct at once
-
-	// Reuse slice capacity if possible to avoid allocation
-	if cap(m.iextras) >= len(backupMsg.iextras) {
-		m.iextras = m.iextras[:len(backupMsg.iextras)]
-	} else {
-		m.iextras = make([]interface{}, len(backupMsg.iextras))
-	}
-	copy(m.iextras, backupMsg.iextras)
-
-	if cap(m.oextras) >= len(backupMsg.oextras) {
-		m.oextras = m.oextras[:len(backupMsg.oextras)]
-	} else {
-		m.oextras = make([]interface{}, len(backupMsg.oextras))
+// closeConn closes the connection. serverConn will reconnect on next usage.
+func (sc *serverConn) closeConn() {
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+		sc.rw = nil
 	}
-	copy(m.oextras, backupMsg.oextras)
 }
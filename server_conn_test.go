@@ -207,3 +207,161 @@ func TestServerConn_Recv(t *testing.T) {
 		t.Errorf("Expected Opaque 123, got %d", m.header.Opaque)
 	}
 }
+
+func TestServerConn_SendStream(t *testing.T) {
+	mockConn := NewMockNetConn()
+	sc := &serverConn{
+		config: DefaultConfig(),
+		conn:   mockConn,
+		rw:     bufio.NewReadWriter(bufio.NewReader(mockConn), bufio.NewWriter(mockConn)),
+	}
+
+	key := "foo"
+	val := bytes.Repeat([]byte("0123456789abcdef"), 10000) // larger than a pooled buffer
+
+	m := &msg{
+		header: header{
+			Op: opSet,
+		},
+		iextras:   []interface{}{uint32(0), uint32(0)},
+		key:       key,
+		valReader: bytes.NewReader(val),
+		valLen:    int64(len(val)),
+	}
+
+	err := sc.send(m)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	written := mockConn.WriteBuf.Bytes()
+	blen := binary.BigEndian.Uint32(written[8:12])
+	if blen != uint32(8+len(key)+len(val)) {
+		t.Errorf("Wrong body length: %d", blen)
+	}
+	if !bytes.Equal(written[24+8+len(key):], val) {
+		t.Errorf("Wrong streamed value")
+	}
+
+	// a short reader must not be reported as a network error
+	m.valReader = bytes.NewReader(val[:100])
+	err = sc.send(m)
+	if err == nil {
+		t.Fatalf("expected error on short reader")
+	}
+	if err.(*Error).Status == StatusNetworkError {
+		t.Errorf("Short reader reported as network error: %v", err)
+	}
+	if sc.conn != nil {
+		t.Errorf("Connection should be dropped after incomplete request")
+	}
+}
+
+func TestServerConn_RecvStream(t *testing.T) {
+	mockConn := NewMockNetConn()
+	sc := &serverConn{
+		config: DefaultConfig(),
+		conn:   mockConn,
+		rw:     bufio.NewReadWriter(bufio.NewReader(mockConn), bufio.NewWriter(mockConn)),
+	}
+
+	val := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	flags := uint32(0xCAFEBABE)
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(uint8(magicRecv))
+	buf.WriteByte(uint8(opGet))
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	buf.WriteByte(4)
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, uint16(StatusOK))
+	binary.Write(buf, binary.BigEndian, uint32(4+len(val)))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint64(999))
+	binary.Write(buf, binary.BigEndian, flags)
+	buf.Write(val)
+	mockConn.ReadBuf.Write(buf.Bytes())
+
+	var gotFlags uint32
+	var out bytes.Buffer
+	m := &msg{
+		oextras:   []interface{}{&gotFlags},
+		valWriter: &out,
+	}
+
+	err := sc.recv(m)
+	if err != nil {
+		t.Fatalf("recv failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), val) {
+		t.Errorf("Wrong streamed value (%d bytes)", out.Len())
+	}
+	if m.val != "" {
+		t.Errorf("Streamed value should not be buffered")
+	}
+	if gotFlags != flags {
+		t.Errorf("Expected flags %x, got %x", flags, gotFlags)
+	}
+	if m.header.CAS != 999 {
+		t.Errorf("Expected CAS 999, got %d", m.header.CAS)
+	}
+}
+
+func TestServerConn_Batch(t *testing.T) {
+	mockConn := NewMockNetConn()
+	sc := &serverConn{
+		config: DefaultConfig(),
+		conn:   mockConn,
+		rw:     bufio.NewReadWriter(bufio.NewReader(mockConn), bufio.NewWriter(mockConn)),
+		opq:    10,
+	}
+
+	ms := []*msg{
+		{header: header{Op: opGetKQ}, key: "miss"},
+		{header: header{Op: opGetKQ}, key: "hit"},
+		{header: header{Op: opSetQ}, iextras: []interface{}{uint32(0), uint32(0)}, key: "k", val: "v"},
+	}
+
+	// respond to the hit and then to the NOOP, which gets opaque 13
+	respond := func(op opCode, opaque uint32, key, val string) {
+		buf := new(bytes.Buffer)
+		buf.WriteByte(uint8(magicRecv))
+		buf.WriteByte(uint8(op))
+		binary.Write(buf, binary.BigEndian, uint16(len(key)))
+		buf.WriteByte(0)
+		buf.WriteByte(0)
+		binary.Write(buf, binary.BigEndian, uint16(StatusOK))
+		binary.Write(buf, binary.BigEndian, uint32(len(key)+len(val)))
+		binary.Write(buf, binary.BigEndian, opaque)
+		binary.Write(buf, binary.BigEndian, uint64(0))
+		buf.WriteString(key)
+		buf.WriteString(val)
+		mockConn.ReadBuf.Write(buf.Bytes())
+	}
+	respond(opGetKQ, 11, "hit", "world")
+	respond(opNoop, 13, "", "")
+
+	err := sc.sendRecvBatch(ms)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+
+	if ms[0].ResvOrStatus != StatusNotFound {
+		t.Errorf("Expected miss for %s, got status %d", ms[0].key, ms[0].ResvOrStatus)
+	}
+	if ms[1].ResvOrStatus != StatusOK || ms[1].val != "world" {
+		t.Errorf("Expected hit for %s, got status %d, val %q", ms[1].key, ms[1].ResvOrStatus, ms[1].val)
+	}
+	if ms[2].ResvOrStatus != StatusOK {
+		t.Errorf("Expected quiet set to succeed, got status %d", ms[2].ResvOrStatus)
+	}
+
+	// all requests are sent in a single write
+	ops := 0
+	for written := mockConn.WriteBuf.Bytes(); len(written) >= 24; ops++ {
+		written = written[24+binary.BigEndian.Uint32(written[8:12]):]
+	}
+	if ops != len(ms)+1 {
+		t.Errorf("Expected %d requests to be written, got %d", len(ms)+1, ops)
+	}
+}
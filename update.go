@@ -0,0 +1,56 @@
+package mc
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Update atomically replaces the value of key with the result of fn, which is
+// given the current value and whether key was found. The value is set with
+// its CAS (or added if key wasn't found), and fn is called again on the latest
+// value when another client changed key in the meantime, up to
+// Config.UpdateRetries times, waiting a random backoff growing from
+// Config.UpdateBackoff between attempts. ErrKeyExists is returned when retries
+// are exhausted, and the errors of fn are returned as is.
+func (c *Client) Update(key string, ttl uint32, fn func(old string, found bool) (string, error)) (val string, cas uint64, err error) {
+	val, _, cas, err = c.update(key, ttl, fn)
+	return val, cas, err
+}
+
+// update is Update but also returns the flags the value was set with.
+func (c *Client) update(key string, ttl uint32, fn func(old string, found bool) (string, error)) (val string, flags uint32, cas uint64, err error) {
+	backoff := c.config.UpdateBackoff
+	for attempt := 0; ; attempt++ {
+		old, flags, ocas, err := c.getCAS(key, 0)
+		found := err == nil
+		if err != nil && err != ErrNotFound {
+			return "", 0, 0, err
+		}
+
+		val, err = fn(old, found)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if found {
+			cas, err = c.Set(key, val, flags, ttl, ocas)
+		} else {
+			flags = 0
+			cas, err = c.Add(key, val, flags, ttl)
+		}
+		// a conflict is a change (including a deletion) since the read, or an
+		// addition if key wasn't found
+		if err == nil || !(err == ErrKeyExists || found && err == ErrNotFound) {
+			return val, flags, cas, err
+		}
+
+		atomic.AddUint64(&c.metrics.updateConflicts, 1)
+		if attempt >= c.config.UpdateRetries {
+			return "", 0, 0, ErrKeyExists
+		}
+		if backoff > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package mc
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	config := DefaultConfig()
+	config.UpdateBackoff = 0
+	fc, c := newTestClient(config)
+
+	incr := func(old string, found bool) (string, error) {
+		n, _ := strconv.Atoi(old)
+		return strconv.Itoa(n + 1), nil
+	}
+
+	// concurrent updates are all applied
+	errs := make(chan error, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, _, err := c.Update("counter", 0, incr)
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+	}
+	v, _, _, err := c.Get("counter")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "100", v, "updates were lost: %v", v)
+
+	// a conflicting write makes fn run again on the latest value
+	other := fc.client("a", DefaultConfig())
+	var calls int
+	v, _, err = c.Update("counter", 0, func(old string, found bool) (string, error) {
+		calls++
+		if calls == 1 {
+			other.Set("counter", "200", 7, 0, 0)
+		}
+		return incr(old, found)
+	})
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "201", v, "update should apply to the latest value: %v", v)
+	assertEqualf(t, 2, calls, "fn should be retried once: %d", calls)
+	_, f, _, _ := c.Get("counter")
+	assertEqualf(t, uint32(7), f, "flags should be kept: %v", f)
+
+	// retries are bounded
+	calls = 0
+	_, _, err = c.Update("counter", 0, func(old string, found bool) (string, error) {
+		calls++
+		other.Set("counter", "0", 0, 0, 0)
+		return "1", nil
+	})
+	assertEqualf(t, ErrKeyExists, err, "expected contention error: %v", err)
+	assertEqualf(t, config.UpdateRetries+1, calls, "wrong number of attempts: %d", calls)
+	assertTruef(t, c.Metrics().UpdateConflicts >= uint64(calls), "conflicts should be counted: %+v", c.Metrics())
+
+	// errors of fn are returned
+	errFn := errors.New("fn failed")
+	_, _, err = c.Update("counter", 0, func(string, bool) (string, error) { return "", errFn })
+	assertEqualf(t, errFn, err, "fn error should be returned: %v", err)
+}
+
+func TestUpdateNotFound(t *testing.T) {
+	fc, c := newTestClient(nil)
+	other := fc.client("a", DefaultConfig())
+
+	var calls int
+	v, _, err := c.Update("foo", 0, func(old string, found bool) (string, error) {
+		calls++
+		if !found {
+			// another client adds the key first
+			other.Add("foo", "theirs", 0, 0)
+			return "new", nil
+		}
+		return old + "+ours", nil
+	})
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "theirs+ours", v, "wrong value: %v", v)
+	assertEqualf(t, 2, calls, "fn should be retried once: %d", calls)
+}
@@ -0,0 +1,42 @@
+package mc
+
+// Transformations applied to values between the caller and the server.
+//
+// encodeValue is applied to all values stored by setGeneric (before they may
+// be chunked) and decodeValue to all values read by Get and GAT (after their
+// chunks are joined). Each transformation records itself in the flags stored
+// with the value, so values are decoded based on how they were stored rather
+// than on the reader's configuration. Values are compressed, encrypted and then
+// wrapped in a checksum envelope, reads undo these steps in reverse order.
+
+// encodeValue transforms val before it is stored under key and returns the
+// flags to store along with it.
+func (c *Client) encodeValue(key, val string, flags uint32) (string, uint32, error) {
+	if c.config.RawFlags && (c.config.ChunkSize > 0 || c.config.Encryption != nil ||
+		c.config.Checksum || c.config.Compression.Compressor != nil) {
+		return val, flags, ErrRawFlags
+	}
+	val, flags, err := c.compress(val, flags)
+	if err != nil {
+		return val, flags, err
+	}
+	val, flags, err = c.encrypt(key, val, flags)
+	if err != nil {
+		return val, flags, err
+	}
+	val, flags = c.addChecksum(key, val, flags)
+	return val, flags, nil
+}
+
+// decodeValue reverses encodeValue for a value read from key with flags.
+func (c *Client) decodeValue(key, val string, flags uint32) (string, error) {
+	val, err := c.verifyChecksum(key, val, flags)
+	if err != nil {
+		return val, err
+	}
+	val, err = c.decrypt(key, val, flags)
+	if err != nil {
+		return val, err
+	}
+	return c.decompress(val, flags)
+}
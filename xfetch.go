@@ -0,0 +1,117 @@
+package mc
+
+// Probabilistic early recomputation.
+//
+// XFetch implements the XFetch algorithm ("Optimal Probabilistic Cache Stampede
+// Prevention", Vattani et al.): values are stored along with the time it took
+// to compute them and their logical expiry, and each read refreshes the value
+// in the background with a probability growing as the expiry approaches and
+// with the compute time, while still serving the cached value. So popular keys
+// are refreshed by a single reader before they expire instead of by all
+// readers at once after.
+//
+// The metadata is stored in a header before the value (compute time and expiry
+// as nanoseconds, 8 bytes each) and marked in the flags, so Get and GAT return
+// the value without it.
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const fetchMetaLen = 16
+
+// fetchRand returns a random number in (0, 1].
+var fetchRand = func() float64 {
+	return 1 - rand.Float64()
+}
+
+// fetchMeta is the metadata stored with values set by XFetch.
+type fetchMeta struct {
+	delta  time.Duration
+	expiry time.Time
+}
+
+// splitFetchMeta splits the metadata from a value according to flags.
+func splitFetchMeta(val string, flags uint32) (string, fetchMeta, bool) {
+	if flags&flagFetchMeta == 0 || len(val) < fetchMetaLen {
+		return val, fetchMeta{}, false
+	}
+	b := []byte(val[:fetchMetaLen])
+	meta := fetchMeta{delta: time.Duration(binary.BigEndian.Uint64(b))}
+	if expiry := int64(binary.BigEndian.Uint64(b[8:])); expiry != 0 {
+		meta.expiry = time.Unix(0, expiry)
+	}
+	return val[fetchMetaLen:], meta, true
+}
+
+// stripFetchMeta removes the metadata from a value according to flags.
+func stripFetchMeta(val string, flags uint32) string {
+	val, _, _ = splitFetchMeta(val, flags)
+	return val
+}
+
+// XFetch retrieves the value of key from the cache, computing it with compute
+// and setting it with expiration ttl on a miss. As the expiry of the value
+// approaches, it's recomputed early in the background, see
+// Config.XFetchBeta. Concurrent computations of the same key within the
+// process are coalesced, as with GetOrLoad. Only errors of compute are
+// returned. With Config.RawFlags, values are never recomputed early.
+func (c *Client) XFetch(key string, ttl uint32, compute func() (string, error)) (string, error) {
+	val, flags, _, err := c.getValue(key, 0)
+	if err == nil {
+		val, meta, ok := splitFetchMeta(val, flags&c.reservedFlags())
+		if ok && c.fetchEarly(meta) {
+			go c.loads.do(key, func() (string, error) {
+				return c.recompute(key, ttl, compute)
+			})
+		}
+		return val, nil
+	}
+	return c.loads.do(key, func() (string, error) {
+		return c.recompute(key, ttl, compute)
+	})
+}
+
+// fetchEarly decides whether a value with meta should be recomputed now.
+func (c *Client) fetchEarly(meta fetchMeta) bool {
+	if meta.expiry.IsZero() {
+		return false
+	}
+	early := time.Duration(-float64(meta.delta) * c.config.XFetchBeta * math.Log(fetchRand()))
+	return !time.Now().Add(early).Before(meta.expiry)
+}
+
+// recompute computes the value of key and sets it along with its metadata.
+func (c *Client) recompute(key string, ttl uint32, compute func() (string, error)) (string, error) {
+	start := time.Now()
+	val, err := compute()
+	if err != nil {
+		return "", err
+	}
+	c.setFetched(key, val, time.Since(start), ttl)
+	return val, nil
+}
+
+// setFetched sets the value of key computed in delta along with its metadata.
+func (c *Client) setFetched(key, val string, delta time.Duration, ttl uint32) {
+	if c.config.RawFlags {
+		// the metadata can't be marked
+		c.Set(key, val, 0, ttl, 0)
+		return
+	}
+	now := time.Now()
+
+	var header [fetchMetaLen]byte
+	binary.BigEndian.PutUint64(header[:], uint64(delta))
+	switch {
+	case ttl == 0:
+	case ttl <= 60*60*24*30:
+		binary.BigEndian.PutUint64(header[8:], uint64(now.Add(time.Duration(ttl)*time.Second).UnixNano()))
+	default:
+		binary.BigEndian.PutUint64(header[8:], uint64(time.Unix(int64(ttl), 0).UnixNano()))
+	}
+	c.store(opSet, key, string(header[:])+val, 0, flagFetchMeta, ttl)
+}
@@ -0,0 +1,87 @@
+package mc
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestXFetch(t *testing.T) {
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.XFetchBeta = 0
+	c := fc.client("a", config)
+
+	var calls int32
+	compute := func() (string, error) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return string('0' + rune(n)), nil
+	}
+
+	v, err := c.XFetch("foo", 60, compute)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "1", v, "wrong value: %v", v)
+
+	it, _ := fc.server("a").get("foo")
+	assertTruef(t, it.flags&flagFetchMeta != 0, "value should be marked")
+	_, meta, ok := splitFetchMeta(it.val, it.flags)
+	assertTruef(t, ok && meta.delta >= 10*time.Millisecond, "compute time should be stored: %v", meta.delta)
+	assertTruef(t, meta.expiry.After(time.Now().Add(59*time.Second)), "expiry should be stored: %v", meta.expiry)
+
+	// Get and GAT return the value without metadata
+	v, f, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "1", v, "wrong value: %v", v)
+	assertEqualf(t, uint32(0), f, "wrong flags: %v", f)
+	v, _, _, err = c.GAT("foo", 60)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "1", v, "wrong value: %v", v)
+
+	// far from expiry, the cached value is served
+	v, err = c.XFetch("foo", 60, compute)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "1", v, "wrong value: %v", v)
+	assertEqualf(t, int32(1), atomic.LoadInt32(&calls), "value shouldn't be recomputed")
+}
+
+func TestXFetchEarly(t *testing.T) {
+	defer func(r func() float64) { fetchRand = r }(fetchRand)
+	fetchRand = func() float64 { return 0.5 }
+
+	fc := newFakeCluster()
+	config := DefaultConfig()
+	config.XFetchBeta = 1e6
+	c := fc.client("a", config)
+
+	var calls int32
+	compute := func() (string, error) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return string('0' + rune(n)), nil
+	}
+
+	_, err := c.XFetch("foo", 60, compute)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	// close to expiry (as scaled by beta), the cached value is served while
+	// it's recomputed in the background
+	v, err := c.XFetch("foo", 60, compute)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "1", v, "cached value should be served: %v", v)
+	for i := 0; i < 100; i++ {
+		if v, _, _, _ = c.Get("foo"); v == "2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqualf(t, "2", v, "value should be recomputed in the background: %v", v)
+
+	// values without expiry are never recomputed early
+	_, err = c.XFetch("bar", 0, compute)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	n := atomic.LoadInt32(&calls)
+	c.XFetch("bar", 0, compute)
+	time.Sleep(50 * time.Millisecond)
+	assertEqualf(t, n, atomic.LoadInt32(&calls), "value without expiry shouldn't be recomputed")
+}